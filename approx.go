@@ -0,0 +1,92 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"unsafe"
+)
+
+const (
+	approxMinSamples      = 256
+	approxQuantileSamples = 16 // Samples per quantile
+)
+
+// ApproxCount returns an estimate of the number of items visible in the
+// snapshot whose keys are in the range [lo, hi). A nil lo or hi leaves the
+// range unbounded.
+// The estimate is computed from the nodes of the upper skiplist levels. Hence,
+// it takes sub-linear time. Ranges with only a few items are counted exactly.
+func (m *Nitro) ApproxCount(snap *Snapshot, lo, hi []byte) int64 {
+	var count int64
+	m.sampleRange(snap, lo, hi, approxMinSamples, func(itms []*Item, weight int64) {
+		count = int64(len(itms)) * weight
+	})
+
+	return count
+}
+
+// ApproxQuantiles returns the n-1 keys which split the items visible in the
+// snapshot into n ranges of approximately equal number of items. Fewer keys
+// are returned if the snapshot does not have enough items.
+// Similar to ApproxCount(), it samples the upper skiplist levels.
+func (m *Nitro) ApproxQuantiles(snap *Snapshot, n int) [][]byte {
+	minSamples := n * approxQuantileSamples
+	if minSamples < approxMinSamples {
+		minSamples = approxMinSamples
+	}
+
+	var keys [][]byte
+	m.sampleRange(snap, nil, nil, minSamples, func(itms []*Item, weight int64) {
+		if len(itms) < n {
+			n = len(itms)
+		}
+
+		for i := 1; i < n; i++ {
+			bs := itms[i*len(itms)/n].Bytes()
+			key := make([]byte, len(bs))
+			copy(key, bs)
+			keys = append(keys, key)
+		}
+	})
+
+	return keys
+}
+
+// sampleRange calls the function with the items visible in the snapshot among
+// the samples of the range [lo, hi) and the number of items represented by
+// each sample. The items are valid only until the function returns.
+func (m *Nitro) sampleRange(snap *Snapshot, lo, hi []byte, minSamples int,
+	fn func(itms []*Item, weight int64)) {
+	var loItm, hiItm unsafe.Pointer
+	if lo != nil {
+		loItm = unsafe.Pointer(m.newItem(lo, false))
+	}
+
+	if hi != nil {
+		hiItm = unsafe.Pointer(m.newItem(hi, false))
+	}
+
+	buf := m.store.MakeBuf()
+	defer m.store.FreeBuf(buf)
+
+	barrier := m.store.GetAccesBarrier()
+	token := barrier.Acquire()
+	defer barrier.Release(token)
+
+	samples, weight := m.store.SampleRange(loItm, hiItm, m.iterCmp, minSamples, buf, &m.store.Stats)
+	itms := make([]*Item, 0, len(samples))
+	for _, ptr := range samples {
+		if itm := (*Item)(ptr); snap.isVisible(itm) {
+			itms = append(itms, itm)
+		}
+	}
+
+	fn(itms, weight)
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+)
+
+// ErrBatchAborted means a mutation of a write batch failed and the batch has
+// been rolled back
+var ErrBatchAborted = fmt.Errorf("Write batch aborted")
+
+const (
+	batchOpPut = iota
+	batchOpDelete
+)
+
+type batchOp struct {
+	op int
+	bs []byte
+}
+
+// WriteBatch stages a group of mutations for a Nitro writer
+// The staged mutations are applied by Commit() under a single snapshot number.
+// Hence, a snapshot either observes all of them or none of them.
+type WriteBatch struct {
+	w   *Writer
+	ops []batchOp
+}
+
+// NewWriteBatch creates an empty write batch for the writer
+func (w *Writer) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{w: w}
+}
+
+// Put stages insert of an item
+func (b *WriteBatch) Put(bs []byte) {
+	b.add(batchOpPut, bs)
+}
+
+// Delete stages delete of an item
+func (b *WriteBatch) Delete(bs []byte) {
+	b.add(batchOpDelete, bs)
+}
+
+func (b *WriteBatch) add(op int, bs []byte) {
+	data := make([]byte, len(bs))
+	copy(data, bs)
+	b.ops = append(b.ops, batchOp{op: op, bs: data})
+}
+
+// Len returns the number of staged mutations
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset discards all staged mutations
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Commit applies the staged mutations in the order they were added.
+// Every mutation is stamped with the same snapshot number and NewSnapshot()
+// waits until the commit has finished. Hence, a snapshot either observes all
+// of the mutations or none of them.
+// Each mutation follows the semantics of Put() and Delete(). If a mutation
+// fails, the mutations applied so far are rolled back and ErrBatchAborted is
+// returned. The rollback is not atomic with respect to the other writers which
+// may observe the intermediate state of the items. The number of mutations
+// applied is returned and the batch is reset.
+// If the memory quota is exceeded, none of the mutations are applied and
+// ErrMemoryQuotaExceeded is returned. If the write-ahead log is enabled, the
+// batch is logged as a single record and the error to log it is returned.
+func (b *WriteBatch) Commit() (applied int, err error) {
+	w := b.w
+	if err = w.checkMemQuota(); err != nil {
+		return
+	}
+
+	var success bool
+	var lsn uint64
+	w.batchLock.RLock()
+	sn := w.getCurrSn()
+	success, lsn, err = w.logBatch(sn, b.ops, func() bool {
+		applied = b.apply(sn)
+		return applied == len(b.ops)
+	})
+	w.batchLock.RUnlock()
+
+	if !success && err == nil {
+		err = ErrBatchAborted
+	}
+	b.Reset()
+
+	// A single sync makes all the mutations of the batch durable
+	err = w.syncMutation(lsn, err)
+	return
+}
+
+// undoOp records how to roll back an applied mutation
+// An insert is undone by deleting the item and a delete is undone by inserting
+// a copy of the deleted item.
+type undoOp struct {
+	op     int
+	bs     []byte
+	expiry uint32
+}
+
+// apply performs the mutations at snapshot number sn until a mutation fails
+// The applied mutations are rolled back in the reverse order on failure.
+func (b *WriteBatch) apply(sn uint32) int {
+	w := b.w
+	undo := make([]undoOp, 0, len(b.ops))
+	for _, op := range b.ops {
+		u := undoOp{op: op.op, bs: op.bs}
+		success := false
+		switch op.op {
+		case batchOpPut:
+			success = w.put(op.bs, sn, 0) != nil
+		case batchOpDelete:
+			match := func(itm *Item) bool {
+				u.bs = append([]byte(nil), itm.Bytes()...)
+				u.expiry = itm.expiry()
+				return true
+			}
+			_, success = w.deleteIf(op.bs, sn, match)
+		}
+
+		if !success {
+			for i := len(undo) - 1; i >= 0; i-- {
+				if undo[i].op == batchOpPut {
+					w.delete(undo[i].bs, sn)
+				} else {
+					w.put(undo[i].bs, sn, undo[i].expiry)
+				}
+			}
+
+			return 0
+		}
+		undo = append(undo, u)
+	}
+
+	return len(undo)
+}
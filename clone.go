@@ -0,0 +1,80 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"context"
+	"github.com/couchbase/nitro/skiplist"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Clone creates a new Nitro instance which holds a copy of the items visible
+// in the snapshot. The clone uses the same configuration, except that it does
+// not use the write-ahead log. It does not share any memory with the source
+// instance, hence either of them can be mutated or closed independently.
+// The items are copied by concurrent workers into skiplist segments, similar
+// to LoadFromDisk(). The snapshot is not closed.
+func (m *Nitro) Clone(snap *Snapshot, concurr int) (*Nitro, error) {
+	if concurr <= 0 {
+		return nil, ErrInvalidConcurrency
+	}
+
+	// A leased snapshot should not expire while its items are being copied
+	if !snap.pin() {
+		return nil, ErrSnapshotClosed
+	}
+	defer snap.unpin()
+
+	if m.useMemoryMgmt {
+		m.shutdownWg1.Add(1)
+		defer m.shutdownWg1.Done()
+	}
+
+	cfg := m.Config
+	cfg.walDir = ""
+	db := NewWithConfig(cfg)
+
+	b := skiplist.NewBuilderWithConfig(db.newStoreConfig())
+	b.SetItemSizeFunc(ItemSize)
+
+	pivotItems := m.splitRange(snap, nil, nil, runtime.NumCPU())
+	segments := make([]*skiplist.Segment, len(pivotItems)-1)
+	for i := range segments {
+		segments[i] = b.NewSegment()
+	}
+
+	err := m.visitShards(pivotItems, concurr, func(shard int, startItem, endItem *Item) error {
+		return m.visitItems(context.Background(), snap, shard, startItem, endItem,
+			func(itm *Item, shard int) error {
+				x := db.newItemWithExpiry(itm.Bytes(), itm.expiry(), db.useMemoryMgmt)
+				if x.expiry() != 0 {
+					atomic.AddInt64(&db.ttlItems, 1)
+				}
+				segments[shard].Add(unsafe.Pointer(x))
+				return nil
+			})
+	})
+
+	// The copied items are owned by the clone. Hence, they are freed by Close()
+	db.store = b.Assemble(segments...)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	db.buildIndexes()
+
+	stats := db.store.GetStats()
+	db.itemsCount = int64(stats.NodeCount)
+
+	return db, nil
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"github.com/couchbase/nitro/skiplist"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Conditional writes are linearizable with respect to the other writers.
+// An insert takes effect once its skiplist node is linked and a delete takes
+// effect once it marks the item dead. A replacement marks the old item as
+// being replaced, which is treated as a live item by the other writers, links
+// the new item and then marks the old item dead. Writers which attempt to
+// delete or replace an item being replaced wait until the replacement is
+// complete.
+
+// PutIfAbsent inserts the item if a live item with the same key does not exist
+// It returns false if the item exists.
+// ErrMemoryQuotaExceeded is returned if the memory quota is configured and
+// the memory usage did not drop below the quota within the timeout.
+func (w *Writer) PutIfAbsent(bs []byte) (bool, error) {
+	if err := w.checkMemQuota(); err != nil {
+		return false, err
+	}
+
+	sn := w.getCurrSn()
+	success, lsn, err := w.logMutation(walOpPut, sn, 0, bs, func() bool {
+		return w.put(bs, sn, 0) != nil
+	})
+
+	return success, w.syncMutation(lsn, err)
+}
+
+// Replace atomically replaces the live item with the same key by the item
+// It returns false if the item does not exist. Lookups observe either the old
+// or the new item.
+func (w *Writer) Replace(bs []byte) (bool, error) {
+	if err := w.checkMemQuota(); err != nil {
+		return false, err
+	}
+
+	barrier := w.store.GetAccesBarrier()
+	token := barrier.Acquire()
+	defer barrier.Release(token)
+
+	sn := w.getCurrSn()
+	success, lsn, err := w.logMutation(walOpReplace, sn, 0, bs, func() bool {
+		for {
+			n := w.getNode(bs, sn)
+			if n == nil || w.expireNode(n, sn, expiryNow()) {
+				return false
+			}
+
+			old := (*Item)(n.Item())
+			if !atomic.CompareAndSwapUint32(&old.deadSn, 0, replacingSn) {
+				// The item has been deleted or it is being replaced
+				waitReplace(old)
+				continue
+			}
+
+			if w.replaceNode(n, bs, sn) {
+				return true
+			}
+		}
+	})
+
+	return success, w.syncMutation(lsn, err)
+}
+
+// replaceNode inserts the new item and removes the node of the old item which
+// has been marked as being replaced
+func (w *Writer) replaceNode(n *skiplist.Node, bs []byte, sn uint32) bool {
+	old := (*Item)(n.Item())
+	x := w.newItem(bs, w.useMemoryMgmt)
+	x.bornSn = sn
+	x.deadSn = replacingSn
+
+	// If the old item was inserted in the current snapshot, both items
+	// have the same key and snapshot number. The new item is placed after
+	// the old item until the old item is removed.
+	xp := unsafe.Pointer(x)
+	insCmp := func(this, that unsafe.Pointer) int {
+		v := w.insCmp(this, that)
+		if v == 0 && this != that {
+			if that == xp {
+				v = -1
+			} else {
+				v = 1
+			}
+		}
+
+		return v
+	}
+
+	xn, success := w.store.Insert2(xp, insCmp, nil, w.buf, w.rand.Float32, &w.slSts1)
+	if !success {
+		atomic.StoreUint32(&old.deadSn, 0)
+		w.freeItem(x)
+		return false
+	}
+
+	w.count++
+	w.removeNode(n, sn)
+	w.insertIndexes(xn)
+	atomic.StoreUint32(&x.deadSn, 0)
+	return true
+}
+
+// waitReplace waits until the replacement of the item is complete
+func waitReplace(itm *Item) {
+	for atomic.LoadUint32(&itm.deadSn) == replacingSn {
+		runtime.Gosched()
+	}
+}
+
+// CompareAndDelete deletes the live item with the same key only if its data
+// equals the given bytes. It returns false if the item does not exist or if
+// it does not match.
+// If the write-ahead log is enabled, the error to log the delete is returned.
+func (w *Writer) CompareAndDelete(bs []byte) (bool, error) {
+	sn := w.getCurrSn()
+	match := func(itm *Item) bool {
+		return bytes.Equal(itm.Bytes(), bs) && !itm.isExpired(expiryNow())
+	}
+
+	success, lsn, err := w.logMutation(walOpDelete, sn, 0, bs, func() bool {
+		_, deleted := w.deleteIf(bs, sn, match)
+		return deleted
+	})
+
+	return success, w.syncMutation(lsn, err)
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"unsafe"
+)
+
+// DiffOp describes the type of change reported by a diff iterator
+type DiffOp int
+
+const (
+	// DiffInsert means the item was inserted after the older snapshot
+	DiffInsert DiffOp = iota
+	// DiffDelete means the item was deleted after the older snapshot
+	DiffDelete
+)
+
+// DiffIterator iterates over the items which differ between two snapshots
+// An item is reported as inserted if it is visible in the newer snapshot and
+// not in the older one. It is reported as deleted if it is visible in the older
+// snapshot and not in the newer one. Items which were inserted and deleted
+// between the two snapshots are skipped.
+type DiffIterator struct {
+	count       int
+	refreshRate int
+
+	older *Snapshot
+	newer *Snapshot
+	iter  *skiplist.Iterator
+	buf   *skiplist.ActionBuffer
+	op    DiffOp
+}
+
+func (it *DiffIterator) skipUnwanted() {
+	for ; it.iter.Valid(); it.iter.Next() {
+		itm := (*Item)(it.iter.Get())
+		inOlder := it.older.isVisible(itm)
+		inNewer := it.newer.isVisible(itm)
+		if inNewer && !inOlder {
+			it.op = DiffInsert
+			return
+		} else if inOlder && !inNewer {
+			it.op = DiffDelete
+			return
+		}
+		it.count++
+	}
+}
+
+// SeekFirst moves cursor to the first changed item
+func (it *DiffIterator) SeekFirst() {
+	it.iter.SeekFirst()
+	it.skipUnwanted()
+}
+
+// Seek moves cursor to the first changed item with the specified key or the
+// next bigger one.
+func (it *DiffIterator) Seek(bs []byte) {
+	itm := it.newer.db.newItem(bs, false)
+	it.iter.Seek(unsafe.Pointer(itm))
+	it.skipUnwanted()
+}
+
+// seekItem moves cursor to the first changed item which is not smaller than
+// the item as per the insert comparator
+func (it *DiffIterator) seekItem(itm *Item) {
+	it.iter.Seek(unsafe.Pointer(itm))
+	it.skipUnwanted()
+}
+
+// Valid returns false when the iterator has reached the end.
+func (it *DiffIterator) Valid() bool {
+	return it.iter.Valid()
+}
+
+// Get returns the current item data from the iterator.
+func (it *DiffIterator) Get() []byte {
+	return (*Item)(it.iter.Get()).Bytes()
+}
+
+// GetNode returns the skiplist node which holds the current item
+func (it *DiffIterator) GetNode() *skiplist.Node {
+	return it.iter.GetNode()
+}
+
+// Op returns the type of change for the current item
+func (it *DiffIterator) Op() DiffOp {
+	return it.op
+}
+
+// Next moves iterator cursor to the next changed item
+func (it *DiffIterator) Next() {
+	it.iter.Next()
+	it.count++
+	it.skipUnwanted()
+	if it.refreshRate > 0 && it.count > it.refreshRate {
+		it.Refresh()
+		it.count = 0
+	}
+}
+
+// Refresh is a helper API to call refresh accessor tokens manually
+func (it *DiffIterator) Refresh() {
+	if it.iter.Valid() {
+		db := it.newer.db
+		itm := db.ptrToItem(it.iter.Get())
+		it.iter.Close()
+		it.iter = db.store.NewIterator(db.insCmp, it.buf)
+		it.iter.Seek(unsafe.Pointer(itm))
+		it.skipUnwanted()
+	}
+}
+
+// SetRefreshRate sets automatic refresh frequency. By default, it is unlimited
+func (it *DiffIterator) SetRefreshRate(rate int) {
+	it.refreshRate = rate
+}
+
+// Close executes destructor for iterator
+func (it *DiffIterator) Close() {
+	it.older.unpin()
+	it.newer.unpin()
+	it.newer.db.store.FreeBuf(it.buf)
+	it.iter.Close()
+}
+
+// NewDiffIterator creates an iterator which returns the items changed from the
+// older snapshot to the newer snapshot. Both the snapshots should belong to the
+// Nitro instance and they are held open until the iterator is closed.
+func (m *Nitro) NewDiffIterator(older, newer *Snapshot) *DiffIterator {
+	if older.sn > newer.sn {
+		panic("older snapshot should not be newer than the newer snapshot")
+	}
+
+	if !older.pin() {
+		return nil
+	}
+
+	if !newer.pin() {
+		older.unpin()
+		return nil
+	}
+
+	buf := m.store.MakeBuf()
+	return &DiffIterator{
+		older: older,
+		newer: newer,
+		iter:  m.store.NewIterator(m.insCmp, buf),
+		buf:   buf,
+	}
+}
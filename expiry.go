@@ -0,0 +1,143 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"sync/atomic"
+	"time"
+)
+
+const expiryCheckInterval = 10000
+
+type expiryStats struct {
+	ItemsExpired uint64
+}
+
+// expiryNow returns the current timestamp used for item expiry
+func expiryNow() uint32 {
+	return uint32(time.Now().Unix())
+}
+
+// expiryTime returns the timestamp after which an item with the ttl expires.
+// It is rounded up to the next second.
+func expiryTime(ttl time.Duration) uint32 {
+	ts := time.Now().Add(ttl).UnixNano()
+	return uint32((ts + int64(time.Second) - 1) / int64(time.Second))
+}
+
+// PutWithTTL inserts an item which expires after the ttl duration
+// An expired item is not visible to snapshots created after the expiry time.
+// It is removed by the background expiry worker if UseItemExpiry is configured.
+// Returns the skiplist node of the item if the insert succeeds. The errors are
+// same as Put().
+func (w *Writer) PutWithTTL(bs []byte, ttl time.Duration) (*skiplist.Node, error) {
+	if err := w.checkMemQuota(); err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&w.ttlItems, 1)
+	var n *skiplist.Node
+	sn, expiry := w.getCurrSn(), expiryTime(ttl)
+	_, lsn, err := w.logMutation(walOpPut, sn, expiry, bs, func() bool {
+		n = w.put(bs, sn, expiry)
+		return n != nil
+	})
+
+	return n, w.syncMutation(lsn, err)
+}
+
+// expireNode deletes the item held by the node if it has expired at timestamp ts.
+// Returns true if the item has expired.
+func (w *Writer) expireNode(n *skiplist.Node, sn uint32, ts uint32) bool {
+	itm := (*Item)(n.Item())
+	if !itm.isExpired(ts) {
+		return false
+	}
+
+	if w.deleteNode(n, sn) {
+		atomic.AddUint64(&w.ItemsExpired, 1)
+	}
+
+	return true
+}
+
+func (m *Nitro) expiryWorker(w *Writer) {
+	defer close(m.expiryDone)
+
+	ticker := time.NewTicker(m.expiryInterval)
+	defer ticker.Stop()
+
+	var pending int64
+	for {
+		select {
+		case <-m.expiryStop:
+			return
+		case <-ticker.C:
+			// Avoid scanning the items unless there are items with expiry
+			if pending += atomic.SwapInt64(&m.ttlItems, 0); pending > 0 {
+				pending = m.expireItems(w)
+			}
+		}
+	}
+}
+
+// expireItems deletes all expired items using the expiry writer and
+// returns the number of live items which are yet to expire.
+// The deleted items are reclaimed by the garbage collector once the
+// snapshots referring them are closed.
+func (m *Nitro) expireItems(w *Writer) (pending int64) {
+	buf := m.store.MakeBuf()
+	defer m.store.FreeBuf(buf)
+	iter := m.store.NewIterator(m.iterCmp, buf)
+	defer iter.Close()
+	iter.SetRefreshInterval(m.refreshRate)
+
+	ts := expiryNow()
+	count := 0
+	for iter.SeekFirst(); iter.Valid(); iter.Next() {
+		if count++; count%expiryCheckInterval == 0 {
+			select {
+			case <-m.expiryStop:
+				return
+			default:
+			}
+		}
+
+		itm := (*Item)(iter.Get())
+		if itm.expiry() == 0 || atomic.LoadUint32(&itm.deadSn) != 0 {
+			continue
+		}
+
+		// Hold off snapshot creation while the writer is mutating
+		m.batchLock.RLock()
+		if !w.expireNode(iter.GetNode(), m.getCurrSn(), ts) {
+			pending++
+		}
+		m.batchLock.RUnlock()
+	}
+
+	return
+}
+
+func (m *Nitro) startExpiryWorker() {
+	if m.expiryInterval > 0 {
+		m.expiryStop = make(chan struct{})
+		m.expiryDone = make(chan struct{})
+		go m.expiryWorker(m.NewWriter())
+	}
+}
+
+func (m *Nitro) stopExpiryWorker() {
+	if m.expiryStop != nil {
+		close(m.expiryStop)
+		<-m.expiryDone
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrSubscriptionClosed means the change feed subscription has been closed
+	ErrSubscriptionClosed = fmt.Errorf("Subscription has been closed")
+	// ErrSubscriptionLagging means the subscription has been closed since its
+	// queue remained full for longer than the change feed timeout
+	ErrSubscriptionLagging = fmt.Errorf("Subscription is lagging behind")
+	// ErrSnapshotClosed means the snapshot provided to resume from is not open
+	ErrSnapshotClosed = fmt.Errorf("Snapshot has been closed")
+)
+
+const (
+	defaultFeedTimeout = time.Second
+	feedPollInterval   = time.Millisecond
+)
+
+// Mutation describes a change of an item reported by the change feed
+// Op is DiffInsert for an inserted item and DiffDelete for a deleted item.
+type Mutation struct {
+	Op   DiffOp
+	Data []byte
+}
+
+// ChangeBatch is the group of mutations which became visible with a snapshot
+// The mutations are ordered by the item key. If an item was replaced, the
+// delete of the old item precedes the insert of the new item.
+type ChangeBatch struct {
+	Sn        uint32
+	Mutations []Mutation
+
+	catchup bool // Mutations are read from the catch-up diff iterator
+}
+
+// Subscription is a change feed consumer handle
+// Batches are buffered in a bounded queue. When the queue is full, the batch
+// is delivered once the consumer catches up. If the queue remains full for
+// longer than the change feed timeout, the subscription is closed and Next()
+// returns ErrSubscriptionLagging. The batches which were queued are dropped
+// and the consumer should resubscribe from a snapshot it has fully processed.
+// Unless Config.UseChangeFeedBackpressure() is set, the writers are not
+// slowed down by a lagging subscriber.
+type Subscription struct {
+	db      *Nitro
+	startSn uint32
+	ch      chan *ChangeBatch
+	closed  chan struct{}
+	once    sync.Once
+	err     error
+
+	// Protects the catch-up state which is set up by the snapshot publisher
+	mu         sync.Mutex
+	resumeFrom *Snapshot
+	catchup    *DiffIterator
+}
+
+// Next returns the next batch of mutations
+// It blocks until a batch is available or the subscription is closed. Once
+// the subscription is closed, it returns the error which closed it.
+func (sub *Subscription) Next() (*ChangeBatch, error) {
+	select {
+	case b := <-sub.ch:
+		if sub.isClosed() {
+			return nil, sub.err
+		}
+		return sub.nextBatch(b)
+	case <-sub.closed:
+		return nil, sub.err
+	}
+}
+
+func (sub *Subscription) isClosed() bool {
+	select {
+	case <-sub.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sub *Subscription) nextBatch(b *ChangeBatch) (*ChangeBatch, error) {
+	if !b.catchup {
+		return b, nil
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	itr := sub.catchup
+	if itr == nil {
+		return nil, sub.err
+	}
+	defer itr.Close()
+	sub.catchup = nil
+
+	cb := &ChangeBatch{Sn: b.Sn}
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		cb.Mutations = append(cb.Mutations, newMutation(itr.Op(), itr.Get()))
+	}
+
+	return cb, nil
+}
+
+// Close unregisters the subscription from the Nitro instance
+func (sub *Subscription) Close() {
+	sub.closeWithError(ErrSubscriptionClosed)
+}
+
+func (sub *Subscription) closeWithError(err error) {
+	sub.once.Do(func() {
+		sub.err = err
+		close(sub.closed)
+		sub.db.removeSubscription(sub)
+
+		sub.mu.Lock()
+		defer sub.mu.Unlock()
+		if sub.resumeFrom != nil {
+			sub.resumeFrom.Close()
+			sub.resumeFrom = nil
+		}
+
+		if sub.catchup != nil {
+			sub.catchup.Close()
+			sub.catchup = nil
+		}
+	})
+}
+
+// publish delivers the batch of the snapshot to the subscriber
+// The batch of the first snapshot after Subscribe() is skipped since it is
+// partially recorded. If the subscription resumes from an older snapshot, it
+// is replaced by the catch-up batch from the older snapshot.
+func (sub *Subscription) publish(snap *Snapshot, b func() *ChangeBatch) {
+	startSn := atomic.LoadUint32(&sub.startSn)
+	if snap.sn < startSn {
+		return
+	}
+
+	if snap.sn == startSn {
+		sub.mu.Lock()
+		resumeFrom := sub.resumeFrom
+		sub.resumeFrom = nil
+		if resumeFrom != nil {
+			sub.catchup = sub.db.NewDiffIterator(resumeFrom, snap)
+			resumeFrom.Close()
+		}
+		sub.mu.Unlock()
+
+		if resumeFrom != nil {
+			sub.send(&ChangeBatch{Sn: snap.sn, catchup: true})
+		}
+		return
+	}
+
+	if batch := b(); len(batch.Mutations) > 0 {
+		sub.send(batch)
+	}
+}
+
+func (sub *Subscription) send(b *ChangeBatch) {
+	select {
+	case sub.ch <- b:
+		return
+	case <-sub.closed:
+		return
+	default:
+	}
+
+	if sub.db.feedBackpressure {
+		atomic.AddInt32(&sub.db.feedLagging, 1)
+		defer atomic.AddInt32(&sub.db.feedLagging, -1)
+
+		select {
+		case sub.ch <- b:
+		case <-sub.closed:
+		}
+		return
+	}
+
+	if timeout := sub.db.feedTimeout; timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case sub.ch <- b:
+			return
+		case <-sub.closed:
+			return
+		case <-timer.C:
+		}
+	}
+
+	sub.closeWithError(ErrSubscriptionLagging)
+}
+
+func newMutation(op DiffOp, bs []byte) Mutation {
+	data := make([]byte, len(bs))
+	copy(data, bs)
+	return Mutation{Op: op, Data: data}
+}
+
+// Subscribe registers a change feed consumer
+// The mutations performed before Subscribe() are partially recorded. Hence,
+// the stream starts from the snapshot boundary: the first snapshot created
+// after Subscribe() does not deliver a batch and every later snapshot delivers
+// a batch with the mutations performed by all the writers since the previous
+// snapshot. Upto bufSize batches are queued.
+//
+// If resumeFrom snapshot is provided, the first snapshot created after
+// Subscribe() delivers a batch containing all changes from resumeFrom to that
+// snapshot. The subscription holds resumeFrom open until then.
+//
+// Similar to NewSnapshot(), this is a thread-unsafe API.
+func (m *Nitro) Subscribe(resumeFrom *Snapshot, bufSize int) (*Subscription, error) {
+	if resumeFrom != nil && !resumeFrom.Open() {
+		return nil, ErrSnapshotClosed
+	}
+
+	sub := &Subscription{
+		db:         m,
+		startSn:    m.getCurrSn(),
+		ch:         make(chan *ChangeBatch, bufSize),
+		closed:     make(chan struct{}),
+		resumeFrom: resumeFrom,
+	}
+
+	m.feedLock.Lock()
+	m.subscribers = append(m.subscribers, sub)
+	m.feedLock.Unlock()
+	atomic.AddInt32(&m.feedActive, 1)
+
+	return sub, nil
+}
+
+func (m *Nitro) removeSubscription(sub *Subscription) {
+	m.feedLock.Lock()
+	defer m.feedLock.Unlock()
+
+	for i, s := range m.subscribers {
+		if s == sub {
+			m.subscribers = append(m.subscribers[:i], m.subscribers[i+1:]...)
+			atomic.AddInt32(&m.feedActive, -1)
+			return
+		}
+	}
+}
+
+func (m *Nitro) closeSubscriptions() {
+	m.feedLock.Lock()
+	subs := append([]*Subscription(nil), m.subscribers...)
+	m.feedLock.Unlock()
+
+	for _, sub := range subs {
+		sub.Close()
+	}
+}
+
+func (w *Writer) recordMutation(bs []byte) {
+	if atomic.LoadInt32(&w.feedActive) > 0 {
+		w.waitForSubscribers()
+		key := make([]byte, len(bs))
+		copy(key, bs)
+		w.feedKeys = append(w.feedKeys, key)
+	}
+}
+
+// waitForSubscribers throttles the writer while NewSnapshot() waits for a
+// lagging subscriber to make room in its queue
+func (w *Writer) waitForSubscribers() {
+	for atomic.LoadInt32(&w.feedLagging) > 0 && !w.hasShutdown {
+		time.Sleep(feedPollInterval)
+	}
+}
+
+type feedKeySorter struct {
+	keys [][]byte
+	cmp  KeyCompare
+}
+
+func (s feedKeySorter) Len() int           { return len(s.keys) }
+func (s feedKeySorter) Less(i, j int) bool { return s.cmp(s.keys[i], s.keys[j]) < 0 }
+func (s feedKeySorter) Swap(i, j int)      { s.keys[i], s.keys[j] = s.keys[j], s.keys[i] }
+
+// publishChanges computes the net changes of the items touched by the writers
+// during the snapshot and delivers them to the subscribers.
+// It is called by NewSnapshot() once the writers have moved to the next
+// snapshot number and before the snapshot is returned. Hence, the items
+// visible to the snapshot and its previous snapshot are not reclaimed.
+func (m *Nitro) publishChanges(snap *Snapshot, keys [][]byte) {
+	m.feedLock.Lock()
+	subs := append([]*Subscription(nil), m.subscribers...)
+	m.feedLock.Unlock()
+
+	if len(subs) == 0 {
+		return
+	}
+
+	var b *ChangeBatch
+	batch := func() *ChangeBatch {
+		if b == nil {
+			b = m.changeBatch(snap.sn, keys)
+		}
+		return b
+	}
+
+	for _, sub := range subs {
+		sub.publish(snap, batch)
+	}
+}
+
+func (m *Nitro) changeBatch(sn uint32, keys [][]byte) *ChangeBatch {
+	sort.Sort(feedKeySorter{keys: keys, cmp: m.keyCmp})
+	b := &ChangeBatch{Sn: sn}
+	for i, key := range keys {
+		if i > 0 && m.keyCmp(keys[i-1], key) == 0 {
+			continue
+		}
+
+		oldItm := m.get(key, sn-1, 0)
+		newItm := m.get(key, sn, 0)
+		if oldItm != newItm {
+			if oldItm != nil {
+				b.Mutations = append(b.Mutations, newMutation(DiffDelete, oldItm.Bytes()))
+			}
+
+			if newItm != nil {
+				b.Mutations = append(b.Mutations, newMutation(DiffInsert, newItm.Bytes()))
+			}
+		}
+	}
+
+	return b
+}
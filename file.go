@@ -11,24 +11,58 @@ package nitro
 
 import "os"
 import "bufio"
+import "bytes"
+import "encoding/binary"
 import "errors"
+import "fmt"
+import "hash/crc32"
+import "io"
+import "github.com/golang/snappy"
 
 var (
 	// DiskBlockSize - backup file reader and writer
 	DiskBlockSize     = 512 * 1024
 	errNotEnoughSpace = errors.New("Not enough space in the buffer")
+	// ErrBackupNotVerifiable means the backup files do not have checksums
+	ErrBackupNotVerifiable = errors.New("Backup file type does not support verification")
 )
 
 // FileType describes backup file format
 type FileType int
 
 const (
-	encodeBufSize = 4
+	encodeBufSize = 8
 	readerBufSize = 10000
 	// RawdbFile - backup file storage format
 	RawdbFile FileType = iota
+	// ChecksumFile - backup file storage format with checksummed blocks
+	ChecksumFile
+	// CompressedFile - backup file storage format with snappy compressed and
+	// checksummed blocks
+	CompressedFile
 )
 
+const snappyCodec = "snappy"
+
+const (
+	blockHeaderSize = 8
+	trailerSize     = 12
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// BackupCorruptionError describes a corrupt backup file
+// Offset is the position of the corrupt block in the file.
+type BackupCorruptionError struct {
+	File   string
+	Offset int64
+	Reason string
+}
+
+func (e *BackupCorruptionError) Error() string {
+	return fmt.Sprintf("Backup file %s is corrupt at offset %d: %s", e.File, e.Offset, e.Reason)
+}
+
 // FileWriter represents backup file writer
 type FileWriter interface {
 	Open(path string) error
@@ -45,16 +79,26 @@ type FileReader interface {
 
 func (m *Nitro) newFileWriter(t FileType) FileWriter {
 	var w FileWriter
-	if t == RawdbFile {
+	switch t {
+	case RawdbFile:
 		w = &rawFileWriter{db: m}
+	case ChecksumFile:
+		w = &checksumFileWriter{db: m}
+	case CompressedFile:
+		w = &checksumFileWriter{db: m, compressed: true}
 	}
 	return w
 }
 
 func (m *Nitro) newFileReader(t FileType, ver int) FileReader {
 	var r FileReader
-	if t == RawdbFile {
+	switch t {
+	case RawdbFile:
 		r = &rawFileReader{db: m, version: ver}
+	case ChecksumFile:
+		r = &checksumFileReader{db: m, version: ver}
+	case CompressedFile:
+		r = &checksumFileReader{db: m, version: ver, compressed: true}
 	}
 	return r
 }
@@ -118,3 +162,226 @@ func (f *rawFileReader) ReadItem() (*Item, error) {
 func (f *rawFileReader) Close() error {
 	return f.fd.Close()
 }
+
+// checksumFileWriter groups the encoded items into blocks
+// Block format: [4 byte len][4 byte crc32c][items]
+// The file ends with a trailer: [4 byte zero][8 byte item count][4 byte crc32c]
+// where the trailer checksum covers the data of all the blocks.
+// If compressed is set, the block data is snappy compressed and the checksums
+// cover the compressed data.
+type checksumFileWriter struct {
+	db    *Nitro
+	fd    *os.File
+	w     *bufio.Writer
+	buf   []byte
+	block bytes.Buffer
+	count uint64
+	crc   uint32
+
+	compressed bool
+	cbuf       []byte
+}
+
+func (f *checksumFileWriter) Open(path string) error {
+	var err error
+	f.fd, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err == nil {
+		f.buf = make([]byte, trailerSize)
+		f.w = bufio.NewWriterSize(f.fd, DiskBlockSize)
+	}
+	return err
+}
+
+func (f *checksumFileWriter) WriteItem(itm *Item) error {
+	if err := f.db.EncodeItem(itm, f.buf, &f.block); err != nil {
+		return err
+	}
+
+	f.count++
+	if f.block.Len() >= DiskBlockSize {
+		return f.flushBlock()
+	}
+
+	return nil
+}
+
+func (f *checksumFileWriter) flushBlock() error {
+	if f.block.Len() == 0 {
+		return nil
+	}
+
+	data := f.block.Bytes()
+	if f.compressed {
+		f.cbuf = snappy.Encode(f.cbuf[:cap(f.cbuf)], data)
+		data = f.cbuf
+	}
+
+	f.crc = crc32.Update(f.crc, crc32cTable, data)
+	binary.BigEndian.PutUint32(f.buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(f.buf[4:8], crc32.Checksum(data, crc32cTable))
+	if _, err := f.w.Write(f.buf[:blockHeaderSize]); err != nil {
+		return err
+	}
+
+	_, err := f.w.Write(data)
+	f.block.Reset()
+	return err
+}
+
+func (f *checksumFileWriter) Close() error {
+	if err := f.flushBlock(); err != nil {
+		return err
+	}
+
+	binary.BigEndian.PutUint32(f.buf[0:4], 0)
+	if _, err := f.w.Write(f.buf[0:4]); err != nil {
+		return err
+	}
+
+	binary.BigEndian.PutUint64(f.buf[0:8], f.count)
+	binary.BigEndian.PutUint32(f.buf[8:12], f.crc)
+	if _, err := f.w.Write(f.buf[:trailerSize]); err != nil {
+		return err
+	}
+
+	if err := f.w.Flush(); err != nil {
+		return err
+	}
+	return f.fd.Close()
+}
+
+// checksumFileReader verifies every block before decoding its items
+// A BackupCorruptionError is returned for a corrupt or truncated file.
+type checksumFileReader struct {
+	version int
+	db      *Nitro
+	fd      *os.File
+	r       *bufio.Reader
+	buf     []byte
+	path    string
+
+	block       bytes.Buffer
+	blockOffset int64
+	offset      int64
+	count       uint64
+	crc         uint32
+	done        bool
+
+	compressed bool
+	raw        bytes.Buffer
+	dbuf       []byte
+}
+
+func (f *checksumFileReader) Open(path string) error {
+	var err error
+	f.fd, err = os.Open(path)
+	if err == nil {
+		f.path = path
+		f.buf = make([]byte, trailerSize)
+		f.r = bufio.NewReaderSize(f.fd, DiskBlockSize)
+	}
+	return err
+}
+
+func (f *checksumFileReader) corrupt(offset int64, reason string) error {
+	return &BackupCorruptionError{File: f.path, Offset: offset, Reason: reason}
+}
+
+func (f *checksumFileReader) readFull(buf []byte) error {
+	n, err := io.ReadFull(f.r, buf)
+	f.offset += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return f.corrupt(f.blockOffset, "unexpected end of file")
+	}
+	return err
+}
+
+// readBlock reads and verifies the next block. It returns with done set if
+// the trailer has been verified.
+func (f *checksumFileReader) readBlock() error {
+	f.blockOffset = f.offset
+	if err := f.readFull(f.buf[0:4]); err != nil {
+		return err
+	}
+
+	l := int64(binary.BigEndian.Uint32(f.buf[0:4]))
+	if l == 0 {
+		if err := f.readFull(f.buf[:trailerSize]); err != nil {
+			return err
+		}
+
+		if binary.BigEndian.Uint64(f.buf[0:8]) != f.count {
+			return f.corrupt(f.blockOffset, "item count mismatch")
+		}
+
+		if binary.BigEndian.Uint32(f.buf[8:12]) != f.crc {
+			return f.corrupt(f.blockOffset, "file checksum mismatch")
+		}
+
+		f.done = true
+		return nil
+	}
+
+	if err := f.readFull(f.buf[4:8]); err != nil {
+		return err
+	}
+	crc := binary.BigEndian.Uint32(f.buf[4:8])
+
+	payload := &f.block
+	if f.compressed {
+		payload = &f.raw
+	}
+
+	payload.Reset()
+	n, err := io.CopyN(payload, f.r, l)
+	f.offset += n
+	if err == io.EOF {
+		return f.corrupt(f.blockOffset, "unexpected end of file")
+	} else if err != nil {
+		return err
+	}
+
+	data := payload.Bytes()
+	if crc32.Checksum(data, crc32cTable) != crc {
+		return f.corrupt(f.blockOffset, "block checksum mismatch")
+	}
+	f.crc = crc32.Update(f.crc, crc32cTable, data)
+
+	if f.compressed {
+		if f.dbuf, err = snappy.Decode(f.dbuf[:cap(f.dbuf)], data); err != nil {
+			return f.corrupt(f.blockOffset, "invalid compressed block")
+		}
+
+		f.block.Reset()
+		f.block.Write(f.dbuf)
+	}
+
+	return nil
+}
+
+func (f *checksumFileReader) ReadItem() (*Item, error) {
+	for f.block.Len() == 0 {
+		if f.done {
+			return nil, nil
+		}
+
+		if err := f.readBlock(); err != nil {
+			return nil, err
+		}
+	}
+
+	itm, err := f.db.DecodeItem(f.version, f.buf, &f.block)
+	if err != nil || itm == nil {
+		if itm != nil {
+			f.db.freeItem(itm)
+		}
+		return nil, f.corrupt(f.blockOffset, "invalid item encoding")
+	}
+
+	f.count++
+	return itm, nil
+}
+
+func (f *checksumFileReader) Close() error {
+	return f.fd.Close()
+}
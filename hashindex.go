@@ -0,0 +1,124 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"github.com/couchbase/nitro/nodetable"
+	"github.com/couchbase/nitro/skiplist"
+	"hash/crc32"
+	"sync"
+	"unsafe"
+)
+
+const hashIndexStripes = 64
+
+// hashIndex maps the keys to the skiplist nodes of their latest items
+// A node table is not thread-safe. Hence, the keys are striped across node
+// tables which are protected by their own locks.
+//
+// The index is only a lookup cache for the skiplist. A node is looked up
+// only if its item is live and the lookups fall back to the skiplist search
+// otherwise. The node of a live item is always indexed except for the window
+// between its insertion and the index update. The nodes are removed from the
+// index before they are freed by the garbage collector.
+type hashIndex struct {
+	hash   nodetable.HashFn
+	tables [hashIndexStripes]*nodetable.NodeTable
+	locks  [hashIndexStripes]sync.Mutex
+}
+
+func newHashIndex(hash nodetable.HashFn, keyCmp KeyCompare) *hashIndex {
+	if hash == nil {
+		hash = crc32.ChecksumIEEE
+	}
+
+	keyEqual := func(p unsafe.Pointer, key []byte) bool {
+		itm := (*Item)((*skiplist.Node)(p).Item())
+		return keyCmp(itm.Bytes(), key) == 0
+	}
+
+	h := &hashIndex{hash: hash}
+	for i := range h.tables {
+		h.tables[i] = nodetable.New(hash, keyEqual)
+	}
+
+	return h
+}
+
+func (h *hashIndex) stripe(key []byte) int {
+	return int(h.hash(key) % hashIndexStripes)
+}
+
+func (h *hashIndex) get(key []byte) *skiplist.Node {
+	i := h.stripe(key)
+	h.locks[i].Lock()
+	defer h.locks[i].Unlock()
+
+	return (*skiplist.Node)(h.tables[i].Get(key))
+}
+
+// update points the key of the item to its node unless the key points to
+// another live item
+func (h *hashIndex) update(n *skiplist.Node) {
+	key := (*Item)(n.Item()).Bytes()
+	i := h.stripe(key)
+	h.locks[i].Lock()
+	defer h.locks[i].Unlock()
+
+	if p := (*skiplist.Node)(h.tables[i].Get(key)); p != nil && !(*Item)(p.Item()).isDead() {
+		return
+	}
+
+	h.tables[i].Update(key, unsafe.Pointer(n))
+}
+
+// remove removes the key of the item if it points to the node
+func (h *hashIndex) remove(n *skiplist.Node) {
+	key := (*Item)(n.Item()).Bytes()
+	i := h.stripe(key)
+	h.locks[i].Lock()
+	defer h.locks[i].Unlock()
+
+	if h.tables[i].Get(key) == unsafe.Pointer(n) {
+		h.tables[i].Remove(key)
+	}
+}
+
+func (h *hashIndex) memoryInUse() (sz int64) {
+	for i := range h.tables {
+		h.locks[i].Lock()
+		sz += h.tables[i].MemoryInUse()
+		h.locks[i].Unlock()
+	}
+
+	return
+}
+
+func (h *hashIndex) close() {
+	for i := range h.tables {
+		h.locks[i].Lock()
+		h.tables[i].Close()
+		h.locks[i].Unlock()
+	}
+}
+
+// lookupNode returns the node of the live item with the key from the hash
+// index if it is enabled
+func (m *Nitro) lookupNode(bs []byte) *skiplist.Node {
+	if m.hashIndex == nil {
+		return nil
+	}
+
+	if n := m.hashIndex.get(bs); n != nil && !(*Item)(n.Item()).isDead() {
+		return n
+	}
+
+	return nil
+}
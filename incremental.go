@@ -0,0 +1,296 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+var (
+	// ErrInvalidBackupBase means the base snapshot does not match the base backup
+	ErrInvalidBackupBase = fmt.Errorf("Base snapshot does not match the base backup")
+	// ErrUnknownCodec means the backup is compressed using an unsupported codec
+	ErrUnknownCodec = fmt.Errorf("Unknown backup compression codec")
+)
+
+// backupManifest describes a backup directory
+// Codec names the compression codec used for the backup files, if any.
+// An incremental backup refers to its base backup using the parent path
+// which is relative to the incremental backup directory.
+// Shards and Delta record the size of the data and delta shard files.
+type backupManifest struct {
+	Version  int           `json:"version"`
+	FileType FileType      `json:"file_type"`
+	Codec    string        `json:"codec,omitempty"`
+	Sn       uint32        `json:"sn,omitempty"`
+	Parent   string        `json:"parent,omitempty"`
+	ParentSn uint32        `json:"parent_sn,omitempty"`
+	Shards   []backupShard `json:"shards,omitempty"`
+	Delta    []backupShard `json:"delta,omitempty"`
+
+	dir string
+}
+
+// backupShard records the number of items and the item data size of a shard
+type backupShard struct {
+	Items int64 `json:"items"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (m *Nitro) newBackupManifest(sn uint32) backupManifest {
+	manifest := backupManifest{Version: version, FileType: m.fileType, Sn: sn}
+	if m.fileType == CompressedFile {
+		manifest.Codec = snappyCodec
+	}
+
+	return manifest
+}
+
+func readManifest(dir string) (*backupManifest, error) {
+	// Backups created by older versions do not record the file type
+	manifest := &backupManifest{FileType: RawdbFile, dir: dir}
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "nitro.json"))
+	if err == nil {
+		err = json.Unmarshal(bs, manifest)
+	} else if os.IsNotExist(err) {
+		// Backups created by older versions may not have a manifest
+		err = nil
+	}
+
+	switch manifest.Codec {
+	case "":
+	case snappyCodec:
+		manifest.FileType = CompressedFile
+	default:
+		err = ErrUnknownCodec
+	}
+
+	return manifest, err
+}
+
+// readBackupChain returns the manifests of the backups required to restore
+// the backup, starting from the full backup
+func readBackupChain(dir string) ([]*backupManifest, error) {
+	var chain []*backupManifest
+	for {
+		manifest, err := readManifest(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append([]*backupManifest{manifest}, chain...)
+		if manifest.Parent == "" {
+			return chain, nil
+		}
+
+		dir = manifest.Parent
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(manifest.dir, dir)
+		}
+
+		if parent, err := readManifest(dir); err != nil {
+			return nil, err
+		} else if parent.Sn != manifest.ParentSn {
+			return nil, fmt.Errorf("Backup %s does not match the base of %s", dir, manifest.dir)
+		}
+	}
+}
+
+// incrementalBase describes the base backup of an incremental backup
+// The parent path is relative to the incremental backup directory.
+type incrementalBase struct {
+	base   *Snapshot
+	parent string
+}
+
+// StoreToDiskIncremental backups the changes from the base snapshot to the
+// snapshot into the directory. The base snapshot should be the snapshot stored
+// in the baseDir backup and it should be kept open until the incremental backup
+// is completed. Hence, the items deleted after the base snapshot are retained
+// in memory until then.
+// The items inserted are stored in data and the items deleted are stored in the
+// deleted directory. Similar to StoreToDisk(), the items are written by
+// concurrent threads. LoadFromDisk restores the incremental backup along with
+// its chain of base backups.
+func (m *Nitro) StoreToDiskIncremental(dir, baseDir string, base, snap *Snapshot,
+	concurr int, itmCallback ItemCallback) error {
+	return m.StoreToDiskIncrementalContext(context.Background(), dir, baseDir, base, snap,
+		concurr, itmCallback)
+}
+
+// StoreToDiskIncrementalContext is same as StoreToDiskIncremental(). The
+// backup is aborted once the context is cancelled as in StoreToDiskContext().
+func (m *Nitro) StoreToDiskIncrementalContext(ctx context.Context, dir, baseDir string,
+	base, snap *Snapshot, concurr int, itmCallback ItemCallback) error {
+
+	baseManifest, err := readManifest(baseDir)
+	if err == nil && (baseManifest.Sn != base.sn || base.sn > snap.sn) {
+		err = ErrInvalidBackupBase
+	}
+
+	var parent string
+	if err == nil {
+		parent, err = relativePath(dir, baseDir)
+	}
+
+	if err != nil {
+		snap.Close()
+		return err
+	}
+
+	return m.storeToDisk(ctx, dir, &incrementalBase{base: base, parent: parent}, snap,
+		concurr, itmCallback)
+}
+
+// storeDiffShard writes the items of a range partition which changed from
+// the base snapshot to the snapshot
+func (m *Nitro) storeDiffShard(ctx context.Context, base, snap *Snapshot, startItem, endItem *Item,
+	w, deletedWriter FileWriter, itmCallback ItemCallback) error {
+
+	itr := m.NewDiffIterator(base, snap)
+	if itr == nil {
+		return ErrSnapshotClosed
+	}
+	defer itr.Close()
+	itr.SetRefreshRate(m.refreshRate)
+
+	if startItem == nil {
+		itr.SeekFirst()
+	} else {
+		itr.seekItem(startItem)
+	}
+
+	for ; itr.Valid(); itr.Next() {
+		n := itr.GetNode()
+		if endItem != nil && m.insCmp(n.Item(), unsafe.Pointer(endItem)) >= 0 {
+			break
+		}
+
+		if isCancelled(ctx) {
+			return ctx.Err()
+		}
+
+		if m.hasShutdown {
+			return ErrShutdown
+		}
+
+		itm := (*Item)(n.Item())
+		fw := w
+		if itr.Op() == DiffDelete {
+			fw = deletedWriter
+		}
+
+		if err := fw.WriteItem(itm); err != nil {
+			return err
+		}
+
+		if itmCallback != nil {
+			itmCallback(&ItemEntry{itm: itm, n: n})
+		}
+	}
+
+	return nil
+}
+
+func relativePath(dir, target string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Rel(absDir, absTarget)
+}
+
+// loadIncrementalBackup applies an incremental backup on top of the restored
+// items. Deleted items are removed before the inserted items are added.
+// This is performed before any snapshot is created and hence the deleted
+// items are freed immediately.
+func (m *Nitro) loadIncrementalBackup(ctx context.Context, manifest *backupManifest, callb ItemCallback) error {
+	w := m.newWriter()
+	defer m.store.Stats.Merge(&w.slSts1)
+
+	process := func(subdir string, fn func(*Item)) error {
+		var files []string
+		bs, err := ioutil.ReadFile(filepath.Join(manifest.dir, subdir, "files.json"))
+		if err != nil {
+			return err
+		}
+		json.Unmarshal(bs, &files)
+
+		for _, file := range files {
+			r := m.newFileReader(manifest.FileType, manifest.Version)
+			if err := r.Open(filepath.Join(manifest.dir, subdir, file)); err != nil {
+				return err
+			}
+
+			for {
+				if isCancelled(ctx) {
+					r.Close()
+					return ctx.Err()
+				}
+
+				itm, err := r.ReadItem()
+				if err != nil {
+					r.Close()
+					return err
+				}
+
+				if itm == nil {
+					break
+				}
+				fn(itm)
+			}
+			r.Close()
+		}
+
+		return nil
+	}
+
+	deleteItem := func(itm *Item) {
+		if _, n, found := m.store.Lookup(unsafe.Pointer(itm), m.iterCmp, w.buf, &w.slSts1); found {
+			if m.store.DeleteNode(n, m.iterCmp, w.buf, &w.slSts1) {
+				m.freeItem((*Item)(n.Item()))
+				m.store.FreeNode(n, &w.slSts1)
+			}
+		}
+		m.freeItem(itm)
+	}
+
+	insertItem := func(itm *Item) {
+		if itm.expiry() != 0 {
+			m.ttlItems++
+		}
+
+		n, success := m.store.Insert2(unsafe.Pointer(itm), m.insCmp, m.existCmp, w.buf,
+			w.rand.Float32, &w.slSts1)
+		if !success {
+			m.freeItem(itm)
+		} else if callb != nil {
+			callb(&ItemEntry{itm: itm, n: n})
+		}
+	}
+
+	if err := process("deleted", deleteItem); err != nil {
+		return err
+	}
+
+	return process("data", insertItem)
+}
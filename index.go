@@ -0,0 +1,242 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"github.com/couchbase/nitro/skiplist"
+	"unsafe"
+)
+
+// KeyExtractor returns the secondary index key of the item data
+type KeyExtractor func(itm []byte) []byte
+
+type indexDef struct {
+	name    string
+	extract KeyExtractor
+	cmp     KeyCompare
+}
+
+// index is a secondary ordering of the Nitro items
+// The index skiplist holds the same items as the Nitro store. Hence, the item
+// visibility is decided by the item snapshot numbers and an index is always
+// consistent with the store for a snapshot. The items are removed from the
+// indexes before they are freed by the garbage collector.
+type index struct {
+	indexDef
+	keyCmp KeyCompare
+	store  *skiplist.Skiplist
+	insCmp skiplist.CompareFn
+}
+
+func newIndex(def indexDef, keyCmp KeyCompare) *index {
+	idx := &index{
+		indexDef: def,
+		keyCmp:   keyCmp,
+		store:    skiplist.New(),
+	}
+
+	idx.insCmp = func(this, that unsafe.Pointer) int {
+		return idx.compare(this, that, nil)
+	}
+
+	return idx
+}
+
+// compare orders the items by their index key followed by the item key.
+// The seek item holds an index key instead of the item data and it is
+// ordered before the items with the same index key.
+func (idx *index) compare(this, that, seek unsafe.Pointer) int {
+	var v int
+	thisItem := (*Item)(this)
+	thatItem := (*Item)(that)
+
+	switch seek {
+	case this:
+		if v = idx.cmp(thisItem.Bytes(), idx.extract(thatItem.Bytes())); v == 0 {
+			v = -1
+		}
+		return v
+	case that:
+		if v = idx.cmp(idx.extract(thisItem.Bytes()), thatItem.Bytes()); v == 0 {
+			v = 1
+		}
+		return v
+	}
+
+	if v = idx.cmp(idx.extract(thisItem.Bytes()), idx.extract(thatItem.Bytes())); v == 0 {
+		if v = idx.keyCmp(thisItem.Bytes(), thatItem.Bytes()); v == 0 {
+			v = int(thisItem.bornSn) - int(thatItem.bornSn)
+		}
+	}
+
+	return v
+}
+
+func (m *Nitro) getIndex(name string) *index {
+	for _, idx := range m.indexes {
+		if idx.name == name {
+			return idx
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) insertIndexes(n *skiplist.Node) {
+	if w.hashIndex != nil {
+		w.hashIndex.update(n)
+	}
+
+	itm := (*Item)(n.Item())
+	for _, idx := range w.indexes {
+		idx.store.Insert2(unsafe.Pointer(itm), idx.insCmp, nil, w.buf,
+			w.rand.Float32, &idx.store.Stats)
+	}
+}
+
+func (m *Nitro) deleteIndexes(n *skiplist.Node, buf *skiplist.ActionBuffer) {
+	if m.hashIndex != nil {
+		m.hashIndex.remove(n)
+	}
+
+	itm := (*Item)(n.Item())
+	for _, idx := range m.indexes {
+		idx.store.Delete(unsafe.Pointer(itm), idx.insCmp, buf, &idx.store.Stats)
+	}
+}
+
+// buildIndexes adds all the items of the store into the indexes and the hash
+// index. It is used once the store has been restored from a backup.
+func (m *Nitro) buildIndexes() {
+	if len(m.indexes) == 0 && m.hashIndex == nil {
+		return
+	}
+
+	w := m.newWriter()
+	buf := m.store.MakeBuf()
+	defer m.store.FreeBuf(buf)
+	iter := m.store.NewIterator(m.iterCmp, buf)
+	defer iter.Close()
+
+	for iter.SeekFirst(); iter.Valid(); iter.Next() {
+		w.insertIndexes(iter.GetNode())
+	}
+}
+
+// IndexIterator iterates the items of a Nitro snapshot in the order of a
+// secondary index
+type IndexIterator struct {
+	snap *Snapshot
+	idx  *index
+	iter *skiplist.Iterator
+	cmp  skiplist.CompareFn
+	buf  *skiplist.ActionBuffer
+	bs   *skiplist.BarrierSession // Protects the items from being freed
+	seek unsafe.Pointer
+}
+
+// NewIndexIterator creates an iterator for a Nitro snapshot on the index
+// registered using Config.AddIndex()
+func (m *Nitro) NewIndexIterator(snap *Snapshot, name string) *IndexIterator {
+	idx := m.getIndex(name)
+	if idx == nil {
+		panic(fmt.Sprintf("Unknown index %s", name))
+	}
+
+	if !snap.pin() {
+		return nil
+	}
+
+	it := &IndexIterator{
+		snap: snap,
+		idx:  idx,
+		buf:  idx.store.MakeBuf(),
+		bs:   m.store.GetAccesBarrier().Acquire(),
+	}
+
+	it.cmp = func(this, that unsafe.Pointer) int {
+		return idx.compare(this, that, it.seek)
+	}
+	it.iter = idx.store.NewIterator(it.cmp, it.buf)
+
+	return it
+}
+
+// NewIndexIterator creates a new snapshot iterator on a secondary index
+func (s *Snapshot) NewIndexIterator(name string) *IndexIterator {
+	return s.db.NewIndexIterator(s, name)
+}
+
+func (it *IndexIterator) skipUnwanted() {
+	for it.iter.Valid() && !it.snap.isVisible((*Item)(it.iter.Get())) {
+		it.iter.Next()
+	}
+}
+
+// SeekFirst moves cursor to the beginning
+func (it *IndexIterator) SeekFirst() {
+	it.iter.SeekFirst()
+	it.skipUnwanted()
+}
+
+// Seek to the first item with the index key or the next bigger one
+func (it *IndexIterator) Seek(key []byte) {
+	it.seek = unsafe.Pointer(it.snap.db.newItem(key, false))
+	it.iter.Seek(it.seek)
+	it.skipUnwanted()
+}
+
+// Valid returns false when the iterator has reached the end
+func (it *IndexIterator) Valid() bool {
+	return it.iter.Valid()
+}
+
+// Get returns the current item data from the iterator
+func (it *IndexIterator) Get() []byte {
+	return (*Item)(it.iter.Get()).Bytes()
+}
+
+// Key returns the index key of the current item
+func (it *IndexIterator) Key() []byte {
+	return it.idx.extract(it.Get())
+}
+
+// Next moves iterator cursor to the next item
+func (it *IndexIterator) Next() {
+	it.iter.Next()
+	it.skipUnwanted()
+}
+
+// Refresh is a helper API to call refresh accessor tokens manually
+// This would enable SMR to reclaim objects faster if an iterator is
+// alive for a longer duration of time.
+func (it *IndexIterator) Refresh() {
+	if it.iter.Valid() {
+		itm := it.snap.db.ptrToItem(it.iter.Get())
+		it.iter.Close()
+
+		barrier := it.snap.db.store.GetAccesBarrier()
+		barrier.Release(it.bs)
+		it.bs = barrier.Acquire()
+
+		it.iter = it.idx.store.NewIterator(it.cmp, it.buf)
+		it.iter.Seek(unsafe.Pointer(itm))
+		it.skipUnwanted()
+	}
+}
+
+// Close executes destructor for iterator
+func (it *IndexIterator) Close() {
+	it.snap.unpin()
+	it.iter.Close()
+	it.idx.store.FreeBuf(it.buf)
+	it.snap.db.store.GetAccesBarrier().Release(it.bs)
+}
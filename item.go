@@ -13,7 +13,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"math"
 	"reflect"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -23,15 +25,27 @@ var itemHeaderSize = unsafe.Sizeof(Item{})
 // The item data is followed by the header.
 // Item data is a block of bytes. The user can store key and value into a
 // block of bytes and provide custom key comparator.
+// The expiry time of an item inserted with a ttl is stored after the item
+// data. The top bit of dataLen marks such items, so that the items without
+// expiry do not pay for it.
 type Item struct {
 	bornSn  uint32
 	deadSn  uint32
 	dataLen uint32
 }
 
+const (
+	itemExpiryFlag = 1 << 31
+	itemExpirySize = 4
+)
+
 func (m *Nitro) newItem(data []byte, useMM bool) (itm *Item) {
+	return m.newItemWithExpiry(data, 0, useMM)
+}
+
+func (m *Nitro) newItemWithExpiry(data []byte, expiry uint32, useMM bool) (itm *Item) {
 	l := len(data)
-	itm = m.allocItem(l, useMM)
+	itm = m.allocItem(l, expiry, useMM)
 	copy(itm.Bytes(), data)
 	return itm
 }
@@ -42,8 +56,12 @@ func (m *Nitro) freeItem(itm *Item) {
 	}
 }
 
-func (m *Nitro) allocItem(l int, useMM bool) (itm *Item) {
+func (m *Nitro) allocItem(l int, expiry uint32, useMM bool) (itm *Item) {
 	blockSize := itemHeaderSize + uintptr(l)
+	if expiry != 0 {
+		blockSize += itemExpirySize
+	}
+
 	if useMM {
 		itm = (*Item)(m.mallocFun(int(blockSize)))
 		itm.deadSn = 0
@@ -54,17 +72,70 @@ func (m *Nitro) allocItem(l int, useMM bool) (itm *Item) {
 	}
 
 	itm.dataLen = uint32(l)
+	if expiry != 0 {
+		itm.dataLen |= itemExpiryFlag
+		itm.setExpiry(expiry)
+	}
 	return
 }
 
+func (itm *Item) dataSize() int {
+	return int(itm.dataLen &^ itemExpiryFlag)
+}
+
+// expiryBytes returns the bytes holding the expiry time of the item
+func (itm *Item) expiryBytes() []byte {
+	p := unsafe.Pointer(uintptr(unsafe.Pointer(itm)) + itemHeaderSize + uintptr(itm.dataSize()))
+	return (*[itemExpirySize]byte)(p)[:]
+}
+
+// expiry returns the expiry time of the item or zero if it does not expire
+func (itm *Item) expiry() uint32 {
+	if itm.dataLen&itemExpiryFlag == 0 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(itm.expiryBytes())
+}
+
+// setExpiry updates the expiry time of an item allocated with an expiry
+func (itm *Item) setExpiry(expiry uint32) {
+	binary.BigEndian.PutUint32(itm.expiryBytes(), expiry)
+}
+
+// replacingSn is the dead snapshot number of an item which is being replaced
+// by Writer.Replace(). The item is treated as a live item until then.
+const replacingSn = math.MaxUint32
+
+// isDead returns true if the item has been deleted
+func (itm *Item) isDead() bool {
+	deadSn := atomic.LoadUint32(&itm.deadSn)
+	return deadSn != 0 && deadSn != replacingSn
+}
+
+// isVisible returns true if the item is alive for the snapshot number sn
+func (itm *Item) isVisible(sn uint32) bool {
+	deadSn := atomic.LoadUint32(&itm.deadSn)
+	return itm.bornSn <= sn && (deadSn == 0 || deadSn > sn || deadSn == replacingSn)
+}
+
+// isExpired returns true if the item has an expiry time which is not later
+// than the timestamp ts. Zero timestamp never expires an item.
+func (itm *Item) isExpired(ts uint32) bool {
+	expiry := itm.expiry()
+	return expiry != 0 && expiry <= ts
+}
+
 // EncodeItem encodes in [4 byte len][item_bytes] format.
+// If the item has an expiry time, the top bit of the length is set and the
+// item bytes are followed by the 4 byte expiry time.
 func (m *Nitro) EncodeItem(itm *Item, buf []byte, w io.Writer) error {
 	l := 4
 	if len(buf) < l {
 		return errNotEnoughSpace
 	}
 
-	binary.BigEndian.PutUint32(buf[0:4], uint32(itm.dataLen))
+	binary.BigEndian.PutUint32(buf[0:4], itm.dataLen)
 	if _, err := w.Write(buf[0:4]); err != nil {
 		return err
 	}
@@ -72,14 +143,22 @@ func (m *Nitro) EncodeItem(itm *Item, buf []byte, w io.Writer) error {
 		return err
 	}
 
+	if itm.dataLen&itemExpiryFlag != 0 {
+		if _, err := w.Write(itm.expiryBytes()); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // DecodeItem decodes encoded item
 // v0: [2 byte len][item_bytes] format.
 // v1: [4 byte len][item_bytes] format.
+// v2: [4 byte len][item_bytes][4 byte expiry if the top bit of len is set] format.
 func (m *Nitro) DecodeItem(ver int, buf []byte, r io.Reader) (*Item, error) {
 	var l int
+	var expiry uint32
 
 	if ver == 0 {
 		if _, err := io.ReadFull(r, buf[0:2]); err != nil {
@@ -90,13 +169,25 @@ func (m *Nitro) DecodeItem(ver int, buf []byte, r io.Reader) (*Item, error) {
 		if _, err := io.ReadFull(r, buf[0:4]); err != nil {
 			return nil, err
 		}
-		l = int(binary.BigEndian.Uint32(buf[0:4]))
+		v := binary.BigEndian.Uint32(buf[0:4])
+		l = int(v &^ itemExpiryFlag)
+		if v&itemExpiryFlag != 0 {
+			// Placeholder until the expiry time is read
+			expiry = math.MaxUint32
+		}
 	}
 
 	if l > 0 {
-		itm := m.allocItem(l, m.useMemoryMgmt)
+		itm := m.allocItem(l, expiry, m.useMemoryMgmt)
 		data := itm.Bytes()
-		_, err := io.ReadFull(r, data)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return itm, err
+		}
+
+		var err error
+		if ver > 1 && expiry != 0 {
+			_, err = io.ReadFull(r, itm.expiryBytes())
+		}
 		return itm, err
 	}
 
@@ -105,7 +196,7 @@ func (m *Nitro) DecodeItem(ver int, buf []byte, r io.Reader) (*Item, error) {
 
 // Bytes return item data bytes
 func (itm *Item) Bytes() (bs []byte) {
-	l := itm.dataLen
+	l := itm.dataSize()
 	dataOffset := uintptr(unsafe.Pointer(itm)) + itemHeaderSize
 
 	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&bs))
@@ -118,7 +209,12 @@ func (itm *Item) Bytes() (bs []byte) {
 // ItemSize returns total bytes consumed by item representation
 func ItemSize(p unsafe.Pointer) int {
 	itm := (*Item)(p)
-	return int(itemHeaderSize + uintptr(itm.dataLen))
+	sz := int(itemHeaderSize) + itm.dataSize()
+	if itm.dataLen&itemExpiryFlag != 0 {
+		sz += itemExpirySize
+	}
+
+	return sz
 }
 
 // KVToBytes encodes key-value pair to item bytes which can be passed
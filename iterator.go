@@ -10,10 +10,23 @@
 package nitro
 
 import (
+	"bytes"
 	"github.com/couchbase/nitro/skiplist"
 	"unsafe"
 )
 
+// IteratorOptions describes the range of items returned by a Nitro iterator
+type IteratorOptions struct {
+	// EndKey is the upper bound of the iterator range. Valid() returns false
+	// once the iterator moves past it.
+	EndKey []byte
+	// InclusiveEnd includes the item with EndKey into the range
+	InclusiveEnd bool
+	// Prefix restricts the iterator to items whose data starts with the prefix.
+	// It requires a key comparator which orders items by their bytes.
+	Prefix []byte
+}
+
 // Iterator implements Nitro snapshot iterator
 type Iterator struct {
 	count       int
@@ -22,6 +35,10 @@ type Iterator struct {
 	snap *Snapshot
 	iter *skiplist.Iterator
 	buf  *skiplist.ActionBuffer
+
+	endKey       []byte
+	inclusiveEnd bool
+	prefix       []byte
 }
 
 func (it *Iterator) skipUnwanted() {
@@ -30,15 +47,44 @@ loop:
 		return
 	}
 	itm := (*Item)(it.iter.Get())
-	if itm.bornSn > it.snap.sn || (itm.deadSn > 0 && itm.deadSn <= it.snap.sn) {
+	if !it.snap.isVisible(itm) {
 		it.iter.Next()
 		it.count++
 		goto loop
 	}
 }
 
+func (it *Iterator) skipUnwantedBackward() {
+	for it.iter.Valid() {
+		itm := (*Item)(it.iter.Get())
+		if it.snap.isVisible(itm) {
+			return
+		}
+		it.iter.Prev()
+		it.count++
+	}
+}
+
+func (it *Iterator) inRange(bs []byte) bool {
+	if it.prefix != nil && !bytes.HasPrefix(bs, it.prefix) {
+		return false
+	}
+
+	if it.endKey != nil {
+		v := it.snap.db.keyCmp(bs, it.endKey)
+		return v < 0 || (v == 0 && it.inclusiveEnd)
+	}
+
+	return true
+}
+
 // SeekFirst moves cursor to the beginning
 func (it *Iterator) SeekFirst() {
+	if it.prefix != nil {
+		it.seek(it.prefix)
+		return
+	}
+
 	it.iter.SeekFirst()
 	it.skipUnwanted()
 }
@@ -46,14 +92,91 @@ func (it *Iterator) SeekFirst() {
 // Seek to a specified key or the next bigger one if an item with key does not
 // exist.
 func (it *Iterator) Seek(bs []byte) {
+	if it.prefix != nil && it.snap.db.keyCmp(bs, it.prefix) < 0 {
+		bs = it.prefix
+	}
+
+	it.seek(bs)
+}
+
+func (it *Iterator) seek(bs []byte) {
 	itm := it.snap.db.newItem(bs, false)
 	it.iter.Seek(unsafe.Pointer(itm))
 	it.skipUnwanted()
 }
 
+// SeekLast moves cursor to the last item
+// For a bounded iterator, it seeks backward from the lower of the end key and
+// the successor of the prefix.
+func (it *Iterator) SeekLast() {
+	end, inclusive := it.endKey, it.inclusiveEnd
+	if it.prefix != nil {
+		succ := prefixSuccessor(it.prefix)
+		if succ != nil && (end == nil || it.snap.db.keyCmp(succ, end) <= 0) {
+			end, inclusive = succ, false
+		}
+	}
+
+	if end == nil {
+		it.iter.SeekLast()
+		it.skipUnwantedBackward()
+		return
+	}
+
+	it.SeekForPrev(end)
+	if !inclusive && it.iter.Valid() && it.snap.db.keyCmp(it.Get(), end) == 0 {
+		it.Prev()
+	}
+}
+
+// SeekForPrev moves cursor to a specified key or the previous smaller one if
+// an item with key does not exist.
+func (it *Iterator) SeekForPrev(bs []byte) {
+	it.seek(bs)
+	if it.iter.Valid() && it.snap.db.keyCmp(it.Get(), bs) == 0 {
+		return
+	}
+
+	it.seekPrevFromCurr()
+}
+
+func (it *Iterator) seekPrevFromCurr() {
+	if it.iter.Valid() {
+		it.iter.Prev()
+	} else {
+		it.iter.SeekLast()
+	}
+	it.skipUnwantedBackward()
+}
+
+// prefixSuccessor returns the smallest key which is bigger than all the keys
+// with the given prefix. It returns nil if there is no such key.
+func prefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := make([]byte, i+1)
+			copy(end, prefix)
+			end[i]++
+			return end
+		}
+	}
+
+	return nil
+}
+
 // Valid eturns false when the iterator has reached the end.
+// For a bounded iterator, it also returns false when the cursor is outside the
+// iterator range.
 func (it *Iterator) Valid() bool {
-	return it.iter.Valid()
+	if !it.iter.Valid() {
+		return false
+	}
+
+	if it.endKey != nil || it.prefix != nil {
+		return it.inRange(it.Get())
+	}
+
+	return true
 }
 
 // Get eturns the current item data from the iterator.
@@ -77,15 +200,27 @@ func (it *Iterator) Next() {
 	}
 }
 
+// Prev moves iterator cursor to the previous item
+func (it *Iterator) Prev() {
+	it.iter.Prev()
+	it.count++
+	it.skipUnwantedBackward()
+	if it.refreshRate > 0 && it.count > it.refreshRate {
+		it.Refresh()
+		it.count = 0
+	}
+}
+
 // Refresh is a helper API to call refresh accessor tokens manually
 // This would enable SMR to reclaim objects faster if an iterator is
 // alive for a longer duration of time.
 func (it *Iterator) Refresh() {
-	if it.Valid() {
+	if it.iter.Valid() {
 		itm := it.snap.db.ptrToItem(it.GetNode().Item())
 		it.iter.Close()
 		it.iter = it.snap.db.store.NewIterator(it.snap.db.iterCmp, it.buf)
 		it.iter.Seek(unsafe.Pointer(itm))
+		it.skipUnwanted()
 	}
 }
 
@@ -98,14 +233,14 @@ func (it *Iterator) SetRefreshRate(rate int) {
 
 // Close executes destructor for iterator
 func (it *Iterator) Close() {
-	it.snap.Close()
+	it.snap.unpin()
 	it.snap.db.store.FreeBuf(it.buf)
 	it.iter.Close()
 }
 
 // NewIterator creates an iterator for a Nitro snapshot
 func (m *Nitro) NewIterator(snap *Snapshot) *Iterator {
-	if !snap.Open() {
+	if !snap.pin() {
 		return nil
 	}
 	buf := snap.db.store.MakeBuf()
@@ -115,3 +250,21 @@ func (m *Nitro) NewIterator(snap *Snapshot) *Iterator {
 		buf:  buf,
 	}
 }
+
+// NewIteratorWithOptions creates an iterator for a Nitro snapshot which is
+// restricted to the range described by the options
+func (m *Nitro) NewIteratorWithOptions(snap *Snapshot, opts IteratorOptions) *Iterator {
+	it := m.NewIterator(snap)
+	if it != nil {
+		if opts.EndKey != nil {
+			it.endKey = append([]byte(nil), opts.EndKey...)
+			it.inclusiveEnd = opts.InclusiveEnd
+		}
+
+		if opts.Prefix != nil {
+			it.prefix = append([]byte(nil), opts.Prefix...)
+		}
+	}
+
+	return it
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type leaseStats struct {
+	SnapshotsExpired uint64
+}
+
+// NewSnapshotWithLease is same as NewSnapshot(). Additionally, the snapshot is
+// force-expired if it has not been closed within the lease timeout. A zero
+// lease means the snapshot never expires.
+func (m *Nitro) NewSnapshotWithLease(lease time.Duration) (*Snapshot, error) {
+	return m.newSnapshot(lease)
+}
+
+// Age returns the time elapsed since the snapshot was created
+func (s *Snapshot) Age() time.Duration {
+	return time.Since(s.created)
+}
+
+// RefCount returns the number of references held on the snapshot
+// It is zero once the snapshot has been closed or force-expired.
+func (s *Snapshot) RefCount() int32 {
+	return atomic.LoadInt32(&s.refCount)
+}
+
+// Expired returns true if the snapshot was force-expired as its lease ended
+func (s *Snapshot) Expired() bool {
+	return atomic.LoadInt32(&s.expired) == 1
+}
+
+// Stack returns the stack trace of the goroutine which created the snapshot
+// It is empty unless the snapshots are tracked using Config.TrackSnapshots().
+func (s *Snapshot) Stack() string {
+	return string(s.stack)
+}
+
+// pin opens the snapshot and prevents it from being force-expired until
+// unpin() is called. Iterators and scans pin their snapshot since the items
+// they visit are reclaimed once the snapshot expires.
+func (s *Snapshot) pin() bool {
+	if s.lease == 0 {
+		return s.Open()
+	}
+
+	s.pinLock.Lock()
+	defer s.pinLock.Unlock()
+
+	if !s.Open() {
+		return false
+	}
+
+	atomic.AddInt32(&s.pins, 1)
+	return true
+}
+
+func (s *Snapshot) unpin() {
+	if s.lease != 0 {
+		atomic.AddInt32(&s.pins, -1)
+	}
+
+	s.Close()
+}
+
+// expire drops all the references of the snapshot so that the garbage
+// collector can reclaim the items which are not visible to later snapshots.
+// A pinned snapshot expires once a later snapshot is created after the scans
+// have completed.
+func (s *Snapshot) expire() bool {
+	s.pinLock.Lock()
+	defer s.pinLock.Unlock()
+
+	if atomic.LoadInt32(&s.pins) > 0 {
+		return false
+	}
+
+	for {
+		rc := atomic.LoadInt32(&s.refCount)
+		if rc <= 0 {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt32(&s.refCount, rc, 0) {
+			atomic.StoreInt32(&s.expired, 1)
+			atomic.AddUint64(&s.db.SnapshotsExpired, 1)
+			s.destroy()
+			return true
+		}
+	}
+}
+
+// expireLeases force-expires the live snapshots whose lease has ended
+// A leaked snapshot holds off the garbage collection of all the later
+// snapshots. It is checked whenever a snapshot is created as the memory held
+// by the leaked snapshot grows only with the new snapshots.
+func (m *Nitro) expireLeases() {
+	if atomic.LoadInt64(&m.leasedSnapshots) == 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, snap := range m.GetSnapshots() {
+		if snap.lease > 0 && now.Sub(snap.created) > snap.lease {
+			snap.expire()
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"container/heap"
+)
+
+// ResolveFn picks the item returned by a merge iterator for a key which is
+// present in multiple iterators. The data of the items is passed in the order
+// of the iterators. It returns the index of the item to be returned or a
+// negative index to skip the key.
+type ResolveFn func(itms [][]byte) int
+
+type mergeEntry struct {
+	iter *Iterator
+	idx  int
+}
+
+// mergeHeap orders the iterators by their current item
+// The iterators with the same key are ordered by their index.
+type mergeHeap struct {
+	entries []mergeEntry
+	cmp     KeyCompare
+}
+
+func (h mergeHeap) Len() int { return len(h.entries) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if v := h.cmp(h.entries[i].iter.Get(), h.entries[j].iter.Get()); v != 0 {
+		return v < 0
+	}
+
+	return h.entries[i].idx < h.entries[j].idx
+}
+
+func (h mergeHeap) Swap(i, j int) { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+
+func (h *mergeHeap) Push(x interface{}) {
+	h.entries = append(h.entries, x.(mergeEntry))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	n := len(h.entries)
+	x := h.entries[n-1]
+	h.entries = h.entries[0 : n-1]
+	return x
+}
+
+// MergeIterator iterates the items of multiple Nitro iterators in the key
+// order. The iterators may belong to different Nitro instances, which should
+// use the same key comparator. A consistent view of the instances requires
+// snapshots which were created while the writers were paused.
+// The items with the same key are returned in the order of the iterators
+// unless a resolve function is provided.
+type MergeIterator struct {
+	iters   []*Iterator
+	h       mergeHeap
+	resolve ResolveFn
+	curr    []byte
+
+	dups   [][]byte
+	popped []mergeEntry
+}
+
+// NewMergeIterator creates an iterator which merges the Nitro iterators
+// If resolve is not nil, it picks the item for a key present in more than one
+// iterator.
+func NewMergeIterator(iters []*Iterator, resolve ResolveFn) *MergeIterator {
+	mit := &MergeIterator{
+		iters:   iters,
+		resolve: resolve,
+	}
+
+	if len(iters) > 0 {
+		mit.h.cmp = iters[0].snap.db.keyCmp
+	}
+
+	return mit
+}
+
+// SeekFirst moves cursor to the first item
+func (mit *MergeIterator) SeekFirst() {
+	mit.h.entries = mit.h.entries[:0]
+	for i, it := range mit.iters {
+		it.SeekFirst()
+		mit.add(it, i)
+	}
+
+	heap.Init(&mit.h)
+	mit.next()
+}
+
+// Seek to the first item with the key or the next bigger one
+func (mit *MergeIterator) Seek(bs []byte) {
+	mit.h.entries = mit.h.entries[:0]
+	for i, it := range mit.iters {
+		it.Seek(bs)
+		mit.add(it, i)
+	}
+
+	heap.Init(&mit.h)
+	mit.next()
+}
+
+func (mit *MergeIterator) add(it *Iterator, idx int) {
+	if it.Valid() {
+		mit.h.entries = append(mit.h.entries, mergeEntry{iter: it, idx: idx})
+	}
+}
+
+// Valid returns false when the iterator has reached the end
+func (mit *MergeIterator) Valid() bool {
+	return mit.curr != nil
+}
+
+// Get returns the current item data from the iterator
+func (mit *MergeIterator) Get() []byte {
+	return mit.curr
+}
+
+// Next moves iterator cursor to the next item
+func (mit *MergeIterator) Next() {
+	mit.next()
+}
+
+// next picks the smallest item among the iterators and moves past it
+// The items remain valid after their iterators move as the items visible in
+// a snapshot are not freed until the snapshot is closed.
+func (mit *MergeIterator) next() {
+	for {
+		mit.curr = nil
+		if mit.h.Len() == 0 {
+			return
+		}
+
+		e := heap.Pop(&mit.h).(mergeEntry)
+		if mit.resolve == nil {
+			mit.curr = e.iter.Get()
+			mit.advance(e)
+			return
+		}
+
+		mit.popped = append(mit.popped[:0], e)
+		mit.dups = append(mit.dups[:0], e.iter.Get())
+		for mit.h.Len() > 0 && mit.h.cmp(mit.h.entries[0].iter.Get(), mit.dups[0]) == 0 {
+			e := heap.Pop(&mit.h).(mergeEntry)
+			mit.popped = append(mit.popped, e)
+			mit.dups = append(mit.dups, e.iter.Get())
+		}
+
+		choice := 0
+		if len(mit.dups) > 1 {
+			choice = mit.resolve(mit.dups)
+		}
+
+		if choice >= 0 {
+			mit.curr = mit.dups[choice]
+		}
+
+		for _, e := range mit.popped {
+			mit.advance(e)
+		}
+
+		if mit.curr != nil {
+			return
+		}
+	}
+}
+
+func (mit *MergeIterator) advance(e mergeEntry) {
+	e.iter.Next()
+	if e.iter.Valid() {
+		heap.Push(&mit.h, e)
+	}
+}
+
+// Close closes all the merged iterators
+func (mit *MergeIterator) Close() {
+	for _, it := range mit.iters {
+		it.Close()
+	}
+}
@@ -11,10 +11,12 @@ package nitro
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"github.com/couchbase/nitro/mm"
+	"github.com/couchbase/nitro/nodetable"
 	"github.com/couchbase/nitro/skiplist"
 	"io"
 	"io/ioutil"
@@ -23,13 +25,14 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 )
 
-const version = 1
+const version = 2
 
 var (
 	// ErrMaxSnapshotsLimitReached means 32 bit integer overflow of snap number
@@ -89,9 +92,11 @@ func CompareNitro(this unsafe.Pointer, that unsafe.Pointer) int {
 func DefaultConfig() Config {
 	var cfg Config
 	cfg.SetKeyComparator(defaultKeyCmp)
+	cfg.customKeyCmp = false
 	cfg.fileType = RawdbFile
 	cfg.useMemoryMgmt = false
 	cfg.refreshRate = defaultRefreshRate
+	cfg.feedTimeout = defaultFeedTimeout
 	return cfg
 }
 
@@ -120,7 +125,7 @@ func newExistCompare(keyCmp KeyCompare) skiplist.CompareFn {
 	return func(this, that unsafe.Pointer) int {
 		thisItem := (*Item)(this)
 		thatItem := (*Item)(that)
-		if thisItem.deadSn != 0 || thatItem.deadSn != 0 {
+		if thisItem.isDead() || thatItem.isDead() {
 			return 1
 		}
 		return keyCmp(thisItem.Bytes(), thatItem.Bytes())
@@ -168,6 +173,9 @@ type Writer struct {
 	slSts1, slSts2, slSts3 skiplist.Stats
 	resSts                 restoreStats
 	count                  int64
+	feedKeys               [][]byte // Keys mutated since the last snapshot
+	quotaChecks            int
+	walStripes             []int
 
 	*Nitro
 }
@@ -198,19 +206,63 @@ func (w *Writer) doDeltaWrite(itm *Item) {
 
 // Put implements insert of an item into Intro
 // Put fails if an item already exists
-func (w *Writer) Put(bs []byte) {
-	w.Put2(bs)
+// ErrMemoryQuotaExceeded is returned if the memory quota is configured and
+// the memory usage did not drop below the quota within the timeout.
+// If the write-ahead log is enabled, the error to log the item is returned.
+func (w *Writer) Put(bs []byte) error {
+	if err := w.checkMemQuota(); err != nil {
+		return err
+	}
+
+	sn := w.getCurrSn()
+	_, lsn, err := w.logMutation(walOpPut, sn, 0, bs, func() bool {
+		return w.put(bs, sn, 0) != nil
+	})
+
+	return w.syncMutation(lsn, err)
 }
 
 // Put2 returns the skiplist node of the item if Put() succeeds
+// It returns nil if the insert fails for any reason. Use Put3() to tell a
+// duplicate item from an error. If the write-ahead log is enabled, the error
+// to log the item is not reported and Put3() should be used instead.
 func (w *Writer) Put2(bs []byte) (n *skiplist.Node) {
+	n, _ = w.Put3(bs)
+	return
+}
+
+// Put3 is same as Put2(). Additionally returns the error of Put().
+// A nil node with a nil error means the item already exists.
+func (w *Writer) Put3(bs []byte) (*skiplist.Node, error) {
+	if err := w.checkMemQuota(); err != nil {
+		return nil, err
+	}
+
+	var n *skiplist.Node
+	sn := w.getCurrSn()
+	_, lsn, err := w.logMutation(walOpPut, sn, 0, bs, func() bool {
+		n = w.put(bs, sn, 0)
+		return n != nil
+	})
+
+	return n, w.syncMutation(lsn, err)
+}
+
+func (w *Writer) put(bs []byte, sn uint32, expiry uint32) (n *skiplist.Node) {
 	var success bool
-	x := w.newItem(bs, w.useMemoryMgmt)
-	x.bornSn = w.getCurrSn()
+	x := w.newItemWithExpiry(bs, expiry, w.useMemoryMgmt)
+	x.bornSn = sn
+retry:
 	n, success = w.store.Insert2(unsafe.Pointer(x), w.insCmp, w.existCmp, w.buf,
 		w.rand.Float32, &w.slSts1)
+	if !success && n != nil && w.expireNode(n, sn, expiryNow()) {
+		goto retry
+	}
+
 	if success {
 		w.count++
+		w.insertIndexes(n)
+		w.recordMutation(bs)
 	} else {
 		w.freeItem(x)
 		n = nil
@@ -220,6 +272,8 @@ func (w *Writer) Put2(bs []byte) (n *skiplist.Node) {
 
 // Delete an item
 // Delete always succeed if an item exists.
+// If the write-ahead log is enabled, the error to log the delete is not
+// reported and Delete3() should be used instead.
 func (w *Writer) Delete(bs []byte) (success bool) {
 	_, success = w.Delete2(bs)
 	return
@@ -227,54 +281,153 @@ func (w *Writer) Delete(bs []byte) (success bool) {
 
 // Delete2 is same as Delete(). Additionally returns the deleted item's node
 func (w *Writer) Delete2(bs []byte) (n *skiplist.Node, success bool) {
-	if n := w.GetNode(bs); n != nil {
-		return n, w.DeleteNode(n)
-	}
+	n, success, _ = w.Delete3(bs)
+	return
+}
+
+// Delete3 is same as Delete2(). Additionally returns the error to log the
+// delete if the write-ahead log is enabled.
+func (w *Writer) Delete3(bs []byte) (n *skiplist.Node, success bool, err error) {
+	var lsn uint64
+	sn := w.getCurrSn()
+	success, lsn, err = w.logMutation(walOpDelete, sn, 0, bs, func() bool {
+		var deleted bool
+		n, deleted = w.delete(bs, sn)
+		return deleted
+	})
+
+	err = w.syncMutation(lsn, err)
+	return
+}
+
+func (w *Writer) delete(bs []byte, sn uint32) (n *skiplist.Node, success bool) {
+	return w.deleteIf(bs, sn, nil)
+}
+
+// deleteIf deletes the live item which matches the key if it is accepted by
+// the match function. If the item is replaced concurrently, the replacement
+// item is looked up again.
+func (w *Writer) deleteIf(bs []byte, sn uint32, match func(*Item) bool) (*skiplist.Node, bool) {
+	barrier := w.store.GetAccesBarrier()
+	token := barrier.Acquire()
+	defer barrier.Release(token)
+
+	for {
+		n := w.getNode(bs, sn)
+		if n == nil {
+			return nil, false
+		}
+
+		itm := (*Item)(n.Item())
+		if match != nil && !match(itm) {
+			return n, false
+		}
 
-	return nil, false
+		if claimed, replaced := w.claimItem(itm, sn); claimed {
+			w.removeNode(n, sn)
+			return n, true
+		} else if !replaced {
+			return n, false
+		}
+	}
 }
 
 // DeleteNode deletes an item by specifying its skiplist Node.
 // Using this API can avoid a O(logn) lookup during Delete().
+// If the write-ahead log is enabled, the error to log the delete is not
+// reported and DeleteNode2() should be used instead.
 func (w *Writer) DeleteNode(x *skiplist.Node) (success bool) {
-	defer func() {
-		if success {
-			w.count--
+	success, _ = w.DeleteNode2(x)
+	return
+}
+
+// DeleteNode2 is same as DeleteNode(). Additionally returns the error to log
+// the delete if the write-ahead log is enabled.
+func (w *Writer) DeleteNode2(x *skiplist.Node) (bool, error) {
+	sn := w.getCurrSn()
+	success, lsn, err := w.logMutation(walOpDelete, sn, 0, (*Item)(x.Item()).Bytes(), func() bool {
+		return w.deleteNode(x, sn)
+	})
+
+	return success, w.syncMutation(lsn, err)
+}
+
+func (w *Writer) deleteNode(x *skiplist.Node, sn uint32) bool {
+	if claimed, _ := w.claimItem((*Item)(x.Item()), sn); claimed {
+		w.removeNode(x, sn)
+		return true
+	}
+
+	return false
+}
+
+// claimItem marks a live item as deleted at snapshot number sn. Only one
+// writer can claim an item. If the item is being replaced, it waits until the
+// replacement completes and reports that the item has been replaced.
+func (w *Writer) claimItem(itm *Item, sn uint32) (claimed bool, replaced bool) {
+	for !atomic.CompareAndSwapUint32(&itm.deadSn, 0, sn) {
+		if atomic.LoadUint32(&itm.deadSn) != replacingSn {
+			return false, replaced
 		}
-	}()
 
+		replaced = true
+		runtime.Gosched()
+	}
+
+	return true, false
+}
+
+// removeNode removes the node of an item claimed by the writer
+// An item inserted in the current snapshot is not visible to any snapshot
+// and it is removed immediately. Otherwise, the node is removed by the
+// garbage collector once the snapshots which can see the item are closed.
+func (w *Writer) removeNode(x *skiplist.Node, sn uint32) {
+	w.count--
 	x.SetLink(nil)
-	sn := w.getCurrSn()
 	gotItem := (*Item)(x.Item())
+	w.recordMutation(gotItem.Bytes())
 	if gotItem.bornSn == sn {
-		success = w.store.DeleteNode(x, w.insCmp, w.buf, &w.slSts1)
+		w.store.DeleteNode(x, w.insCmp, w.buf, &w.slSts1)
+		atomic.StoreUint32(&gotItem.deadSn, sn)
+		w.deleteIndexes(x, w.buf)
 
 		barrier := w.store.GetAccesBarrier()
 		barrier.FlushSession(unsafe.Pointer(x))
 		return
 	}
 
-	success = atomic.CompareAndSwapUint32(&gotItem.deadSn, 0, sn)
-	if success {
-		if w.gctail == nil {
-			w.gctail = x
-			w.gchead = w.gctail
-		} else {
-			w.gctail.SetLink(x)
-			w.gctail = x
-		}
+	atomic.StoreUint32(&gotItem.deadSn, sn)
+	if w.gctail == nil {
+		w.gctail = x
+		w.gchead = w.gctail
+	} else {
+		w.gctail.SetLink(x)
+		w.gctail = x
 	}
-	return
 }
 
 // GetNode implements lookup of an item and return its skiplist Node
 // This API enables to lookup an item without using a snapshot handle.
 func (w *Writer) GetNode(bs []byte) *skiplist.Node {
+	return w.getNode(bs, w.getCurrSn())
+}
+
+func (w *Writer) getNode(bs []byte, sn uint32) *skiplist.Node {
+	if w.hashIndex != nil {
+		barrier := w.store.GetAccesBarrier()
+		token := barrier.Acquire()
+		n := w.lookupNode(bs)
+		barrier.Release(token)
+		if n != nil {
+			return n
+		}
+	}
+
 	iter := w.store.NewIterator(w.iterCmp, w.buf)
 	defer iter.Close()
 
 	x := w.newItem(bs, false)
-	x.bornSn = w.getCurrSn()
+	x.bornSn = sn
 
 	if found := iter.SeekWithCmp(unsafe.Pointer(x), w.insCmp, w.existCmp); found {
 		return iter.GetNode()
@@ -283,25 +436,82 @@ func (w *Writer) GetNode(bs []byte) *skiplist.Node {
 	return nil
 }
 
+// Get returns the data of the latest live item which matches the given key.
+// It returns nil if the item does not exist.
+// The returned bytes belong to the item and should not be modified.
+func (w *Writer) Get(bs []byte) []byte {
+	if itm := w.get(bs, math.MaxUint32, expiryNow()); itm != nil {
+		return itm.Bytes()
+	}
+
+	return nil
+}
+
+// get performs a point lookup for the item visible at snapshot number sn
+// which has not expired at timestamp ts without creating an iterator.
+func (m *Nitro) get(bs []byte, sn uint32, ts uint32) *Item {
+	barrier := m.store.GetAccesBarrier()
+	token := barrier.Acquire()
+	defer barrier.Release(token)
+
+	x := m.newItem(bs, false)
+	filter := func(p unsafe.Pointer) bool {
+		itm := (*Item)(p)
+		return itm.isVisible(sn) && !itm.isExpired(ts)
+	}
+
+	if n := m.lookupNode(bs); n != nil && filter(n.Item()) {
+		return (*Item)(n.Item())
+	}
+
+	if n := m.store.Find(unsafe.Pointer(x), m.iterCmp, filter); n != nil {
+		return (*Item)(n.Item())
+	}
+
+	return nil
+}
+
 // Config - Nitro instance configuration
 type Config struct {
-	keyCmp   KeyCompare
-	insCmp   skiplist.CompareFn
-	iterCmp  skiplist.CompareFn
-	existCmp skiplist.CompareFn
+	keyCmp       KeyCompare
+	insCmp       skiplist.CompareFn
+	iterCmp      skiplist.CompareFn
+	existCmp     skiplist.CompareFn
+	customKeyCmp bool
 
 	refreshRate int
 	fileType    FileType
 
-	useMemoryMgmt bool
-	useDeltaFiles bool
-	mallocFun     skiplist.MallocFn
-	freeFun       skiplist.FreeFn
+	useMemoryMgmt  bool
+	useDeltaFiles  bool
+	mallocFun      skiplist.MallocFn
+	freeFun        skiplist.FreeFn
+	expiryInterval time.Duration
+
+	memQuota        int64
+	memQuotaLow     int64
+	memQuotaTimeout time.Duration
+
+	walDir      string
+	walPolicy   WALSyncPolicy
+	walInterval time.Duration
+
+	indexDefs []indexDef
+
+	feedTimeout      time.Duration
+	feedBackpressure bool
+
+	useHashIndex bool
+	hashFn       nodetable.HashFn
+
+	snapshotLease  time.Duration
+	trackSnapshots bool
 }
 
 // SetKeyComparator provides key comparator for the Nitro item data
 func (cfg *Config) SetKeyComparator(cmp KeyCompare) {
 	cfg.keyCmp = cmp
+	cfg.customKeyCmp = true
 	cfg.insCmp = newInsertCompare(cmp)
 	cfg.iterCmp = newIterCompare(cmp)
 	cfg.existCmp = newExistCompare(cmp)
@@ -324,6 +534,111 @@ func (cfg *Config) UseDeltaInterleaving() {
 	cfg.useDeltaFiles = true
 }
 
+// SetFileType sets the file format used for disk backups
+// The file format of a backup is detected by LoadFromDisk().
+func (cfg *Config) SetFileType(t FileType) {
+	cfg.fileType = t
+}
+
+// UseItemExpiry option enables a background worker which deletes the items
+// inserted by PutWithTTL() once they expire. The worker scans for expired items
+// every interval. The expired items are reclaimed by the garbage collector.
+func (cfg *Config) UseItemExpiry(interval time.Duration) {
+	cfg.expiryInterval = interval
+}
+
+// SetMemoryQuota limits the memory used by the Nitro instance items
+// Once MemoryInUse() reaches the quota, inserts are throttled until the memory
+// usage drops below the lowWatermark as the garbage collector reclaims deleted
+// items. A throttled insert waits for upto timeout and fails with
+// ErrMemoryQuotaExceeded if the memory usage has not dropped by then.
+// The memory usage is sampled periodically by each writer. Hence, the quota
+// may be exceeded by a small number of items.
+func (cfg *Config) SetMemoryQuota(quota, lowWatermark int64, timeout time.Duration) {
+	if lowWatermark > quota {
+		lowWatermark = quota
+	}
+
+	cfg.memQuota = quota
+	cfg.memQuotaLow = lowWatermark
+	cfg.memQuotaTimeout = timeout
+}
+
+// UseWAL option enables a write-ahead log in the directory which records the
+// mutations performed by Put and Delete APIs. LoadFromDisk replays the log on top
+// of the restored backup and the log is truncated once a newer backup completes.
+// The log of a previous instance is kept until LoadFromDisk has replayed it.
+// The interval is used by WALSyncInterval policy. A default interval is used
+// if it is not positive.
+// The mutations of different keys are logged concurrently. With a custom key
+// comparator, the keys are told apart using the hash function of the hash
+// index. Without a hash index, the mutations are logged one at a time.
+func (cfg *Config) UseWAL(dir string, policy WALSyncPolicy, interval time.Duration) {
+	cfg.walDir = dir
+	cfg.walPolicy = policy
+	cfg.walInterval = interval
+}
+
+// AddIndex registers a secondary index which orders the items by the key
+// returned by the extractor using the comparator. The indexes are updated by
+// the Writer APIs along with the items and they can be iterated using
+// Snapshot.NewIndexIterator().
+func (cfg *Config) AddIndex(name string, extract KeyExtractor, cmp KeyCompare) {
+	for _, def := range cfg.indexDefs {
+		if def.name == name {
+			panic(fmt.Sprintf("Index %s already exists", name))
+		}
+	}
+
+	cfg.indexDefs = append(cfg.indexDefs, indexDef{name: name, extract: extract, cmp: cmp})
+}
+
+// SetChangeFeedTimeout sets how long NewSnapshot() waits to deliver a change
+// batch to a subscriber whose queue is full. The subscription is closed with
+// ErrSubscriptionLagging once the timeout expires. A zero timeout closes the
+// lagging subscriptions without waiting.
+func (cfg *Config) SetChangeFeedTimeout(timeout time.Duration) {
+	cfg.feedTimeout = timeout
+}
+
+// UseChangeFeedBackpressure option makes NewSnapshot() wait for a subscriber
+// whose queue is full instead of closing the subscription. Meanwhile, the
+// writers are throttled as they record their mutations. Hence, the change
+// batches must be consumed by goroutines other than the writers and the
+// caller of NewSnapshot(). The change feed timeout is not used.
+func (cfg *Config) UseChangeFeedBackpressure() {
+	cfg.feedBackpressure = true
+}
+
+// UseHashIndex option maintains a hash index of the keys which enables point
+// lookups of the live items without searching the skiplist. The hash function
+// should return the same hash for the keys which are equal as per the key
+// comparator. The item data is hashed using crc32 if hash is nil, which is
+// suitable for the default key comparator.
+func (cfg *Config) UseHashIndex(hash nodetable.HashFn) {
+	cfg.useHashIndex = true
+	cfg.hashFn = hash
+}
+
+// SetSnapshotLease option force-expires the snapshots created by NewSnapshot()
+// which have not been closed within the lease timeout. Otherwise, a snapshot
+// which is never closed holds off the garbage collector forever.
+// An expired snapshot cannot be opened and closing it has no effect. The items
+// visible to an expired snapshot may be reclaimed by the garbage collector.
+// Hence, a snapshot does not expire while it has open iterators or while it
+// is being visited, backed up or cloned. It expires once a later snapshot is
+// created after they have completed.
+func (cfg *Config) SetSnapshotLease(timeout time.Duration) {
+	cfg.snapshotLease = timeout
+}
+
+// TrackSnapshots option records the stack trace of the creator of every
+// snapshot, which is reported by Snapshot.Stack(). It helps to find the
+// snapshots which are not closed using GetSnapshots().
+func (cfg *Config) TrackSnapshots() {
+	cfg.trackSnapshots = true
+}
+
 type restoreStats struct {
 	DeltaRestored      uint64
 	DeltaRestoreFailed uint64
@@ -341,6 +656,29 @@ type Nitro struct {
 	leastUnrefSn uint32
 	itemsCount   int64
 
+	// Write batches hold the read lock while they are applied so that
+	// NewSnapshot cannot advance currSn in the middle of a batch
+	batchLock sync.RWMutex
+
+	feedLock    sync.Mutex
+	feedActive  int32
+	feedLagging int32 // Subscribers which NewSnapshot() is waiting for
+	subscribers []*Subscription
+
+	quotaExceeded int32
+
+	leasedSnapshots int64 // Live snapshots which have a lease
+
+	ttlItems   int64 // Items inserted with expiry since the last expiry scan
+	expiryStop chan struct{}
+	expiryDone chan struct{}
+
+	wal       *wal
+	indexes   []*index
+	hashIndex *hashIndex
+
+	progress unsafe.Pointer // *progressTracker of the last backup or restore
+
 	wlist    *Writer
 	gcchan   chan *skiplist.Node
 	freechan chan *skiplist.Node
@@ -351,6 +689,8 @@ type Nitro struct {
 
 	Config
 	restoreStats
+	expiryStats
+	leaseStats
 }
 
 // NewWithConfig creates a new Nitro instance based on provided configuration.
@@ -371,6 +711,19 @@ func NewWithConfig(cfg Config) *Nitro {
 	buf := dbInstances.MakeBuf()
 	defer dbInstances.FreeBuf(buf)
 	dbInstances.Insert(unsafe.Pointer(m), CompareNitro, buf, &dbInstances.Stats)
+	m.startExpiryWorker()
+
+	if m.walDir != "" {
+		m.wal = openWAL(m.walDir, m.walPolicy, m.walInterval, m.walKeyHash())
+	}
+
+	for _, def := range m.indexDefs {
+		m.indexes = append(m.indexes, newIndex(def, m.keyCmp))
+	}
+
+	if m.useHashIndex {
+		m.hashIndex = newHashIndex(m.hashFn, m.keyCmp)
+	}
 
 	return m
 
@@ -412,11 +765,30 @@ func New() *Nitro {
 // MemoryInUse returns total memory used by the Nitro instance.
 func (m *Nitro) MemoryInUse() int64 {
 	storeStats := m.aggrStoreStats()
-	return storeStats.Memory + m.snapshots.MemoryInUse() + m.gcsnapshots.MemoryInUse()
+	sz := storeStats.Memory + m.snapshots.MemoryInUse() + m.gcsnapshots.MemoryInUse()
+	if m.hashIndex != nil {
+		sz += m.hashIndex.memoryInUse()
+	}
+
+	for _, idx := range m.indexes {
+		sz += idx.store.MemoryInUse()
+	}
+
+	return sz
 }
 
 // Close shuts down the nitro instance
 func (m *Nitro) Close() {
+	m.closeSubscriptions()
+	m.stopExpiryWorker()
+	if m.wal != nil {
+		m.wal.close()
+	}
+
+	if m.hashIndex != nil {
+		m.hashIndex.close()
+	}
+
 	// Wait until all snapshot iterators have finished
 	for s := m.snapshots.GetStats(); int(s.NodeCount) != 0; s = m.snapshots.GetStats() {
 		time.Sleep(time.Millisecond)
@@ -507,18 +879,32 @@ func (m *Nitro) NewWriter() *Writer {
 // Snapshot describes Nitro immutable snapshot
 type Snapshot struct {
 	sn       uint32
+	ts       uint32 // Items which expire by this time are not visible
 	refCount int32
+	expired  int32
 	db       *Nitro
 	count    int64
 
+	created time.Time
+	lease   time.Duration
+	stack   []byte
+	pins    int32       // Scans which prevent the snapshot from expiring
+	pinLock *sync.Mutex // Serializes the pins of a leased snapshot with expire()
+
 	gclist *skiplist.Node
 }
 
 // SnapshotSize returns the memory used by Nitro snapshot metadata
 func SnapshotSize(p unsafe.Pointer) int {
 	s := (*Snapshot)(p)
-	return int(unsafe.Sizeof(s.sn) + unsafe.Sizeof(s.refCount) + unsafe.Sizeof(s.db) +
-		unsafe.Sizeof(s.count) + unsafe.Sizeof(s.gclist))
+	return int(unsafe.Sizeof(s.sn) + unsafe.Sizeof(s.ts) + unsafe.Sizeof(s.refCount) + unsafe.Sizeof(s.db) +
+		unsafe.Sizeof(s.count) + unsafe.Sizeof(s.gclist) + unsafe.Sizeof(s.expired) +
+		unsafe.Sizeof(s.created) + unsafe.Sizeof(s.lease) + unsafe.Sizeof(s.stack) + uintptr(len(s.stack)) +
+		unsafe.Sizeof(s.pins) + unsafe.Sizeof(s.pinLock))
+}
+
+func (s *Snapshot) isVisible(itm *Item) bool {
+	return itm.isVisible(s.sn) && !itm.isExpired(s.ts)
 }
 
 // Count returns the number of items in the Nitro snapshot
@@ -555,27 +941,61 @@ func (s *Snapshot) Decode(buf []byte, r io.Reader) error {
 // When snapshots are shared by multiple threads, each thread should Open the
 // snapshot. This API internally tracks the reference count for the snapshot.
 func (s *Snapshot) Open() bool {
-	if atomic.LoadInt32(&s.refCount) == 0 {
-		return false
+	for {
+		rc := atomic.LoadInt32(&s.refCount)
+		if rc <= 0 {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt32(&s.refCount, rc, rc+1) {
+			return true
+		}
 	}
-	atomic.AddInt32(&s.refCount, 1)
-	return true
 }
 
 // Close is the snapshot descructor
 // Once a thread has finished using a snapshot, it can be destroyed by calling
 // Close(). Internal garbage collector takes care of freeing the items.
 func (s *Snapshot) Close() {
-	newRefcount := atomic.AddInt32(&s.refCount, -1)
-	if newRefcount == 0 {
-		buf := s.db.snapshots.MakeBuf()
-		defer s.db.snapshots.FreeBuf(buf)
+	for {
+		rc := atomic.LoadInt32(&s.refCount)
+		if rc <= 0 {
+			// The snapshot has been force-expired
+			return
+		}
 
-		// Move from live snapshot list to dead list
-		s.db.snapshots.Delete(unsafe.Pointer(s), CompareSnapshot, buf, &s.db.snapshots.Stats)
-		s.db.gcsnapshots.Insert(unsafe.Pointer(s), CompareSnapshot, buf, &s.db.gcsnapshots.Stats)
-		s.db.GC()
+		if atomic.CompareAndSwapInt32(&s.refCount, rc, rc-1) {
+			if rc == 1 {
+				s.destroy()
+			}
+			return
+		}
+	}
+}
+
+func (s *Snapshot) destroy() {
+	buf := s.db.snapshots.MakeBuf()
+	defer s.db.snapshots.FreeBuf(buf)
+
+	if s.lease > 0 {
+		atomic.AddInt64(&s.db.leasedSnapshots, -1)
 	}
+
+	// Move from live snapshot list to dead list
+	s.db.snapshots.Delete(unsafe.Pointer(s), CompareSnapshot, buf, &s.db.snapshots.Stats)
+	s.db.gcsnapshots.Insert(unsafe.Pointer(s), CompareSnapshot, buf, &s.db.gcsnapshots.Stats)
+	s.db.GC()
+}
+
+// Get returns the data of the item visible in the snapshot which matches the
+// given key. It returns nil if the item does not exist in the snapshot.
+// The returned bytes are valid until the snapshot is closed.
+func (s *Snapshot) Get(bs []byte) []byte {
+	if itm := s.db.get(bs, s.sn, s.ts); itm != nil {
+		return itm.Bytes()
+	}
+
+	return nil
 }
 
 // NewIterator creates a new snapshot iterator
@@ -583,6 +1003,11 @@ func (s *Snapshot) NewIterator() *Iterator {
 	return s.db.NewIterator(s)
 }
 
+// NewIteratorWithOptions creates a new bounded snapshot iterator
+func (s *Snapshot) NewIteratorWithOptions(opts IteratorOptions) *Iterator {
+	return s.db.NewIteratorWithOptions(s, opts)
+}
+
 // CompareSnapshot implements comparator for snapshots based on snapshot number
 func CompareSnapshot(this, that unsafe.Pointer) int {
 	thisItem := (*Snapshot)(this)
@@ -595,12 +1020,20 @@ func CompareSnapshot(this, that unsafe.Pointer) int {
 // This is a thread-unsafe API.
 // While this API is invoked, no other Nitro writer should concurrently call any
 // public APIs such as Put*() and Delete*().
+// The snapshot is force-expired after the lease set by Config.SetSnapshotLease().
 func (m *Nitro) NewSnapshot() (*Snapshot, error) {
+	return m.newSnapshot(m.snapshotLease)
+}
+
+func (m *Nitro) newSnapshot(lease time.Duration) (*Snapshot, error) {
 	buf := m.snapshots.MakeBuf()
 	defer m.snapshots.FreeBuf(buf)
 
+	m.batchLock.Lock()
+
 	// Stitch all local gclists from all writers to create snapshot gclist
 	var head, tail *skiplist.Node
+	var feedKeys [][]byte
 
 	for w := m.wlist; w != nil; w = w.next {
 		if tail == nil {
@@ -614,16 +1047,33 @@ func (m *Nitro) NewSnapshot() (*Snapshot, error) {
 		w.gchead = nil
 		w.gctail = nil
 
+		feedKeys = append(feedKeys, w.feedKeys...)
+		w.feedKeys = nil
+
 		// Update global stats
 		m.store.Stats.Merge(&w.slSts1)
 		atomic.AddInt64(&m.itemsCount, w.count)
 		w.count = 0
 	}
 
-	snap := &Snapshot{db: m, sn: m.getCurrSn(), refCount: 1, count: m.ItemsCount()}
+	snap := &Snapshot{db: m, sn: m.getCurrSn(), ts: expiryNow(), refCount: 1, count: m.ItemsCount(),
+		created: time.Now(), lease: lease}
+	if m.trackSnapshots {
+		snap.stack = debug.Stack()
+	}
+
+	if lease > 0 {
+		snap.pinLock = new(sync.Mutex)
+		atomic.AddInt64(&m.leasedSnapshots, 1)
+	}
 	m.snapshots.Insert(unsafe.Pointer(snap), CompareSnapshot, buf, &m.snapshots.Stats)
 	snap.gclist = head
 	newSn := atomic.AddUint32(&m.currSn, 1)
+	m.batchLock.Unlock()
+
+	// A slow subscriber should not hold off the writers
+	m.publishChanges(snap, feedKeys)
+	m.expireLeases()
 	if newSn == math.MaxUint32 {
 		return nil, ErrMaxSnapshotsLimitReached
 	}
@@ -653,6 +1103,7 @@ func (m *Nitro) collectionWorker(w *Writer) {
 			for n := gclist; n != nil; n = n.GetLink() {
 				w.doDeltaWrite((*Item)(n.Item()))
 				m.store.DeleteNode(n, m.insCmp, buf, &w.slSts2)
+				m.deleteIndexes(n, buf)
 			}
 
 			m.store.Stats.Merge(&w.slSts2)
@@ -665,21 +1116,24 @@ func (m *Nitro) collectionWorker(w *Writer) {
 
 func (m *Nitro) freeWorker(w *Writer) {
 	for freelist := range m.freechan {
-		for n := freelist; n != nil; {
-			dnode := n
-			n = n.GetLink()
-
-			itm := (*Item)(dnode.Item())
-			m.freeItem(itm)
-			m.store.FreeNode(dnode, &w.slSts3)
-		}
-
+		m.freeNodes(freelist, &w.slSts3)
 		m.store.Stats.Merge(&w.slSts3)
 	}
 
 	m.shutdownWg2.Done()
 }
 
+func (m *Nitro) freeNodes(freelist *skiplist.Node, sts *skiplist.Stats) {
+	for n := freelist; n != nil; {
+		dnode := n
+		n = n.GetLink()
+
+		itm := (*Item)(dnode.Item())
+		m.freeItem(itm)
+		m.store.FreeNode(dnode, sts)
+	}
+}
+
 // Invariant: Each snapshot n is dependent on snapshot n-1.
 // Unless snapshot n-1 is collected, snapshot n cannot be collected.
 func (m *Nitro) collectDead() {
@@ -698,7 +1152,7 @@ func (m *Nitro) collectDead() {
 			return
 		}
 
-		m.lastGCSn = sn.sn
+		atomic.StoreUint32(&m.lastGCSn, sn.sn)
 		m.gcchan <- sn.gclist
 		m.gcsnapshots.DeleteNode(node, CompareSnapshot, buf2, &m.gcsnapshots.Stats)
 	}
@@ -713,7 +1167,8 @@ func (m *Nitro) GC() {
 }
 
 // GetSnapshots returns the list of current live snapshots
-// This API is mainly for debugging purpose
+// This API is mainly for debugging purpose. The snapshots which have not been
+// closed can be found using their Age(), RefCount() and Stack().
 func (m *Nitro) GetSnapshots() []*Snapshot {
 	var snaps []*Snapshot
 	buf := m.snapshots.MakeBuf()
@@ -729,7 +1184,7 @@ func (m *Nitro) GetSnapshots() []*Snapshot {
 
 func (m *Nitro) ptrToItem(itmPtr unsafe.Pointer) *Item {
 	o := (*Item)(itmPtr)
-	itm := m.newItem(o.Bytes(), false)
+	itm := m.newItemWithExpiry(o.Bytes(), o.expiry(), false)
 	*itm = *o
 
 	return itm
@@ -739,44 +1194,239 @@ func (m *Nitro) ptrToItem(itmPtr unsafe.Pointer) *Item {
 // This API divides the range of keys in a snapshot into `shards` range partitions
 // Number of concurrent worker threads used can be specified.
 func (m *Nitro) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concurrency int) error {
-	var wg sync.WaitGroup
-	var pivotItems []*Item
+	return m.VisitorContext(context.Background(), snap, callb, shards, concurrency)
+}
+
+// isCancelled checks whether the context has been cancelled without blocking
+func isCancelled(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// VisitorContext is same as Visitor(). Additionally, the workers stop visiting
+// items once the context is cancelled and ctx.Err() is returned.
+func (m *Nitro) VisitorContext(ctx context.Context, snap *Snapshot, callb VisitorCallback,
+	shards int, concurrency int) error {
+	return m.VisitorWithOptions(ctx, snap, callb, shards, concurrency, VisitorOptions{})
+}
+
+// VisitorOptions restricts the range of a snapshot visitor and the order of
+// the callbacks
+type VisitorOptions struct {
+	// StartKey is the lower bound of the visited range. The item with StartKey
+	// is included. A nil StartKey denotes the beginning of the snapshot.
+	StartKey []byte
+	// EndKey is the upper bound of the visited range. The item with EndKey is
+	// excluded. A nil EndKey denotes the end of the snapshot.
+	EndKey []byte
+	// Ordered invokes the callback for the items in the key order. The shards
+	// are still visited by the concurrent workers, but the callbacks are
+	// invoked one at a time from the calling goroutine.
+	Ordered bool
+}
+
+// visitorQueueSize is the number of items a worker of an ordered visitor can
+// buffer ahead of the callbacks
+const visitorQueueSize = 1024
+
+// errVisitorStopped stops the workers of an ordered visitor once a callback fails
+var errVisitorStopped = fmt.Errorf("Visitor stopped")
+
+// VisitorWithOptions is same as VisitorContext(). Additionally, the visitor is
+// restricted to the range of keys and the callbacks are ordered as per the
+// options. The range is divided into `shards` range partitions.
+func (m *Nitro) VisitorWithOptions(ctx context.Context, snap *Snapshot, callb VisitorCallback,
+	shards int, concurrency int, opts VisitorOptions) error {
+	if !snap.pin() {
+		return ErrSnapshotClosed
+	}
+	defer snap.unpin()
+
+	pivots := m.splitRange(snap, opts.StartKey, opts.EndKey, shards)
+
+	visit := func(shard int, startItem, endItem *Item) error {
+		return m.visitItems(ctx, snap, shard, startItem, endItem, callb)
+	}
+
+	if !opts.Ordered {
+		return m.visitShards(pivots, concurrency, visit)
+	}
+
+	return m.visitOrdered(ctx, snap, pivots, concurrency, callb)
+}
+
+// visitItems calls the callback for the items of the snapshot from the start
+// item until the end item
+func (m *Nitro) visitItems(ctx context.Context, snap *Snapshot, shard int, startItem, endItem *Item,
+	callb VisitorCallback) error {
+	itr := m.NewIterator(snap)
+	if itr == nil {
+		return ErrSnapshotClosed
+	}
+	defer itr.Close()
+
+	itr.SetRefreshRate(m.refreshRate)
+	if startItem == nil {
+		itr.SeekFirst()
+	} else {
+		itr.Seek(startItem.Bytes())
+	}
+
+	for ; itr.Valid(); itr.Next() {
+		if endItem != nil && m.insCmp(itr.GetNode().Item(), unsafe.Pointer(endItem)) >= 0 {
+			break
+		}
+
+		if isCancelled(ctx) {
+			return ctx.Err()
+		}
+
+		itm := (*Item)(itr.GetNode().Item())
+		if err := callb(itm, shard); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// visitOrdered visits the partitions concurrently into bounded queues and
+// invokes the callback for the queued items in the order of the partitions.
+// The workers pick the partitions in order. Hence, the partition whose items
+// are being delivered always has a worker. The items stay valid in the queues
+// as the items visible in the snapshot are not freed until it is closed.
+func (m *Nitro) visitOrdered(ctx context.Context, snap *Snapshot, pivots []*Item, concurrency int,
+	callb VisitorCallback) error {
+	queues := make([]chan *Item, len(pivots)-1)
+	for i := range queues {
+		queues[i] = make(chan *Item, visitorQueueSize)
+	}
+
+	visited := make([]bool, len(queues))
+	stop := make(chan struct{})
+	errch := make(chan error, 1)
+
+	enqueue := func(itm *Item, shard int) error {
+		select {
+		case queues[shard] <- itm:
+			return nil
+		case <-stop:
+			return errVisitorStopped
+		}
+	}
+
+	go func() {
+		err := m.visitShards(pivots, concurrency, func(shard int, startItem, endItem *Item) error {
+			visited[shard] = true
+			defer close(queues[shard])
+			return m.visitItems(ctx, snap, shard, startItem, endItem, enqueue)
+		})
+
+		// The workers skip the remaining partitions on an error
+		for shard, done := range visited {
+			if !done {
+				close(queues[shard])
+			}
+		}
+		errch <- err
+	}()
+
+	var err error
+deliver:
+	for shard, q := range queues {
+		for itm := range q {
+			if err = callb(itm, shard); err != nil {
+				close(stop)
+				break deliver
+			}
+		}
+	}
+
+	if verr := <-errch; err == nil && verr != errVisitorStopped {
+		err = verr
+	}
+
+	return err
+}
 
-	wch := make(chan int, shards)
+// splitRange divides the range of keys [lo, hi) of the snapshot into range
+// partitions. It returns the pivot items where the partitions start followed
+// by the end item of the range. A nil pivot denotes the beginning or the end
+// of the snapshot.
+func (m *Nitro) splitRange(snap *Snapshot, lo, hi []byte, shards int) []*Item {
+	var pivotItems []*Item
+	var loItm, hiItm *Item
 
 	if snap == nil {
 		panic("snapshot cannot be nil")
 	}
 
-	func() {
-		tmpIter := m.NewIterator(snap)
-		if tmpIter == nil {
-			panic("iterator cannot be nil")
+	if lo != nil {
+		loItm = m.newItem(lo, false)
+	}
+
+	if hi != nil {
+		hiItm = m.newItem(hi, false)
+	}
+
+	tmpIter := m.NewIterator(snap)
+	if tmpIter == nil {
+		panic("iterator cannot be nil")
+	}
+	defer tmpIter.Close()
+
+	barrier := m.store.GetAccesBarrier()
+	token := barrier.Acquire()
+	defer barrier.Release(token)
+
+	var pivotPtrs []unsafe.Pointer
+	if lo == nil && hi == nil {
+		pivotPtrs = m.store.GetRangeSplitItems(shards)
+	} else if shards > 1 {
+		// Pick the pivots evenly from the level which has enough nodes in the range
+		buf := m.store.MakeBuf()
+		defer m.store.FreeBuf(buf)
+		samples, _ := m.store.SampleRange(unsafe.Pointer(loItm), unsafe.Pointer(hiItm), m.iterCmp,
+			shards, buf, &m.store.Stats)
+		for i := 1; i < shards && len(samples) >= shards; i++ {
+			pivotPtrs = append(pivotPtrs, samples[i*len(samples)/shards])
 		}
-		defer tmpIter.Close()
+	}
 
-		barrier := m.store.GetAccesBarrier()
-		token := barrier.Acquire()
-		defer barrier.Release(token)
-
-		pivotItems = append(pivotItems, nil) // start item
-		pivotPtrs := m.store.GetRangeSplitItems(shards)
-		for _, itmPtr := range pivotPtrs {
-			itm := m.ptrToItem(itmPtr)
-			tmpIter.Seek(itm.Bytes())
-			if tmpIter.Valid() {
-				prevItm := pivotItems[len(pivotItems)-1]
-				// Find bigger item than prev pivot
-				if prevItm == nil || m.insCmp(unsafe.Pointer(itm), unsafe.Pointer(prevItm)) > 0 {
-					pivotItems = append(pivotItems, itm)
-				}
+	pivotItems = append(pivotItems, loItm) // start item
+	for _, itmPtr := range pivotPtrs {
+		itm := m.ptrToItem(itmPtr)
+		tmpIter.Seek(itm.Bytes())
+		if tmpIter.Valid() {
+			prevItm := pivotItems[len(pivotItems)-1]
+			// Find bigger item than prev pivot
+			if prevItm == nil || m.insCmp(unsafe.Pointer(itm), unsafe.Pointer(prevItm)) > 0 {
+				pivotItems = append(pivotItems, itm)
 			}
 		}
-		pivotItems = append(pivotItems, nil) // end item
-	}()
+	}
+	pivotItems = append(pivotItems, hiItm) // end item
+
+	return pivotItems
+}
+
+// visitShards calls the visit function for each range partition from the
+// worker threads. A partition starts at its pivot item and ends before the
+// next pivot item. A nil start or end item denotes the beginning or the end
+// of the snapshot.
+func (m *Nitro) visitShards(pivotItems []*Item, concurrency int,
+	visit func(shard int, startItem, endItem *Item) error) error {
+	var wg sync.WaitGroup
 
 	errors := make([]error, len(pivotItems)-1)
 
+	// Workers may exit on an error. Hence, the channel should hold all the shards.
+	wch := make(chan int, len(pivotItems)-1)
+
 	// Run workers
 	for i := 0; i < concurrency; i++ {
 		wg.Add(1)
@@ -784,32 +1434,8 @@ func (m *Nitro) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concu
 			defer wg.Done()
 
 			for shard := range wch {
-				startItem := pivotItems[shard]
-				endItem := pivotItems[shard+1]
-
-				itr := m.NewIterator(snap)
-				if itr == nil {
-					panic("iterator cannot be nil")
-				}
-				defer itr.Close()
-
-				itr.SetRefreshRate(m.refreshRate)
-				if startItem == nil {
-					itr.SeekFirst()
-				} else {
-					itr.Seek(startItem.Bytes())
-				}
-			loop:
-				for ; itr.Valid(); itr.Next() {
-					if endItem != nil && m.insCmp(itr.GetNode().Item(), unsafe.Pointer(endItem)) >= 0 {
-						break loop
-					}
-
-					itm := (*Item)(itr.GetNode().Item())
-					if err := callb(itm, shard); err != nil {
-						errors[shard] = err
-						return
-					}
+				if errors[shard] = visit(shard, pivotItems[shard], pivotItems[shard+1]); errors[shard] != nil {
+					return
 				}
 			}
 		}(&wg)
@@ -876,53 +1502,197 @@ func (m *Nitro) changeDeltaWrState(state int,
 	return err
 }
 
+// backupFiles describes the kind of the shard files of a backup
+type backupFiles int
+
+const (
+	// dataFiles hold the items of the snapshot or the items inserted since
+	// the base snapshot of an incremental backup
+	dataFiles backupFiles = iota
+	// deltaFiles hold the items removed by the GC during a backup
+	deltaFiles
+	// deletedFiles hold the items deleted since the base snapshot of an
+	// incremental backup
+	deletedFiles
+)
+
+var backupSubdirs = []string{"data", "delta", "deleted"}
+
+// backupTarget creates the files of a backup
+type backupTarget interface {
+	// newFileWriter returns the writer for a shard of the given kind
+	newFileWriter(kind backupFiles, shard int) (FileWriter, error)
+	writeManifest(manifest backupManifest) error
+	// commit is called once the shards of the given kind have been written
+	commit(kind backupFiles) error
+}
+
+type diskBackup struct {
+	db    *Nitro
+	dir   string
+	files [][]string
+}
+
+func (b *diskBackup) newFileWriter(kind backupFiles, shard int) (FileWriter, error) {
+	w := b.db.newFileWriter(b.db.fileType)
+	file := fmt.Sprintf("shard-%d", shard)
+	dir := filepath.Join(b.dir, backupSubdirs[kind])
+	os.MkdirAll(dir, 0755)
+
+	if err := w.Open(filepath.Join(dir, file)); err != nil {
+		return nil, err
+	}
+
+	if b.files == nil {
+		b.files = make([][]string, len(backupSubdirs))
+	}
+	b.files[kind] = append(b.files[kind], file)
+
+	return w, nil
+}
+
+func (b *diskBackup) writeManifest(manifest backupManifest) error {
+	bs, _ := json.Marshal(manifest)
+	return ioutil.WriteFile(filepath.Join(b.dir, "nitro.json"), bs, 0660)
+}
+
+func (b *diskBackup) commit(kind backupFiles) error {
+	var files []string
+	if b.files != nil {
+		files = b.files[kind]
+	}
+
+	bs, _ := json.Marshal(files)
+	dir := filepath.Join(b.dir, backupSubdirs[kind])
+	os.MkdirAll(dir, 0755)
+	return ioutil.WriteFile(filepath.Join(dir, "files.json"), bs, 0660)
+}
+
+// remove deletes the files of a partially written backup
+func (b *diskBackup) remove() {
+	os.Remove(filepath.Join(b.dir, "nitro.json"))
+	for _, subdir := range backupSubdirs {
+		os.RemoveAll(filepath.Join(b.dir, subdir))
+	}
+}
+
 // StoreToDisk backups Nitro snapshot to disk
 // Concurrent threads are used to perform backup and concurrency can be specified.
 func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback ItemCallback) (err error) {
+	return m.StoreToDiskContext(context.Background(), dir, snap, concurr, itmCallback)
+}
+
+// StoreToDiskContext is same as StoreToDisk(). Additionally, the backup is
+// aborted once the context is cancelled. The partially written backup files
+// are removed and ctx.Err() is returned.
+func (m *Nitro) StoreToDiskContext(ctx context.Context, dir string, snap *Snapshot,
+	concurr int, itmCallback ItemCallback) (err error) {
+	return m.storeToDisk(ctx, dir, nil, snap, concurr, itmCallback)
+}
+
+func (m *Nitro) storeToDisk(ctx context.Context, dir string, incr *incrementalBase, snap *Snapshot,
+	concurr int, itmCallback ItemCallback) (err error) {
+	b := &diskBackup{db: m, dir: dir}
+	os.MkdirAll(filepath.Join(dir, "data"), 0755)
+
+	sn := snap.sn
+	if err = m.storeSnapshot(ctx, b, incr, snap, concurr, itmCallback); err == nil {
+		err = m.truncateWAL(sn)
+	} else if ctx.Err() != nil {
+		err = ctx.Err()
+		b.remove()
+	}
+
+	return err
+}
+
+// storeSnapshot writes the items of the snapshot into the backup target and
+// closes the snapshot. If the base of an incremental backup is provided, only
+// the items inserted or deleted since the base snapshot are written.
+func (m *Nitro) storeSnapshot(ctx context.Context, b backupTarget, incr *incrementalBase,
+	snap *Snapshot, concurr int, itmCallback ItemCallback) (err error) {
 
 	var snapClosed bool
 	defer func() {
 		if !snapClosed {
-			snap.Close()
+			snap.unpin()
 		}
 	}()
 
+	// The pin replaces the reference of the caller so that a leased snapshot
+	// does not expire while its items are being written
+	if !snap.pin() {
+		snapClosed = true
+		return ErrSnapshotClosed
+	}
+	snap.Close()
+
 	if m.useMemoryMgmt {
 		m.shutdownWg1.Add(1)
 		defer m.shutdownWg1.Done()
 	}
 
-	manifestdir := dir
-	datadir := filepath.Join(dir, "data")
-	os.MkdirAll(datadir, 0755)
 	shards := runtime.NumCPU()
+	p := m.startProgress(false, snap.Count())
+	counters := p.setShards(false, shards, nil)
+
+	// The manifest is written once the data and delta shards are complete
+	// so that it can record their sizes for the restore progress
+	sn := snap.sn
+	defer func() {
+		if err == nil {
+			manifest := m.newBackupManifest(sn)
+			manifest.Shards = p.backupShards(false)
+			manifest.Delta = p.backupShards(true)
+			if incr != nil {
+				manifest.Parent = incr.parent
+				manifest.ParentSn = incr.base.sn
+			}
+
+			if err = b.writeManifest(manifest); err == nil {
+				p.setPhase(ProgressDone)
+			}
+		}
+	}()
 
-	writers := make([]FileWriter, shards)
-	files := make([]string, shards)
+	var writers, deletedWriters []FileWriter
 	defer func() {
-		for _, w := range writers {
+		for _, w := range append(writers, deletedWriters...) {
 			if w != nil {
 				w.Close()
 			}
 		}
 	}()
 
-	for shard := 0; shard < shards; shard++ {
-		w := m.newFileWriter(m.fileType)
-		file := fmt.Sprintf("shard-%d", shard)
-		datafile := filepath.Join(datadir, file)
-		if err := w.Open(datafile); err != nil {
-			return err
+	kinds := []backupFiles{dataFiles}
+	if incr != nil {
+		kinds = append(kinds, deletedFiles)
+	}
+
+	for _, kind := range kinds {
+		ws := make([]FileWriter, shards)
+		if kind == dataFiles {
+			writers = ws
+		} else {
+			deletedWriters = ws
 		}
 
-		writers[shard] = w
-		files[shard] = file
+		for shard := 0; shard < shards; shard++ {
+			w, err := b.newFileWriter(kind, shard)
+			if err != nil {
+				return err
+			}
+
+			// Deleted items are counted along with the inserted items
+			ws[shard] = &progressWriter{FileWriter: w, c: counters[shard]}
+		}
 	}
 
 	// Initialize and setup delta processing
-	if m.useDeltaFiles {
+	// An incremental backup holds the snapshots open as it reads the items
+	// deleted since the base snapshot.
+	if m.useDeltaFiles && incr == nil {
 		deltaWriters := make([]FileWriter, m.numWriters())
-		deltaFiles := make([]string, m.numWriters())
 		defer func() {
 			for _, w := range deltaWriters {
 				if w != nil {
@@ -931,17 +1701,13 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 			}
 		}()
 
-		deltadir := filepath.Join(dir, "delta")
-		os.MkdirAll(deltadir, 0755)
+		deltaCounters := p.setShards(true, len(deltaWriters), nil)
 		for id := 0; id < m.numWriters(); id++ {
-			dw := m.newFileWriter(m.fileType)
-			file := fmt.Sprintf("shard-%d", id)
-			deltafile := filepath.Join(deltadir, file)
-			if err = dw.Open(deltafile); err != nil {
+			dw, err := b.newFileWriter(deltaFiles, id)
+			if err != nil {
 				return err
 			}
-			deltaWriters[id] = dw
-			deltaFiles[id] = file
+			deltaWriters[id] = &progressWriter{FileWriter: dw, c: deltaCounters[id]}
 		}
 
 		if err = m.changeDeltaWrState(dwStateInit, deltaWriters, snap); err != nil {
@@ -952,16 +1718,16 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		// The fakeSnap object is to use the same iterator without any special handling for
 		// usual refcount based freeing.
 
-		snap.Close()
+		snap.unpin()
 		snapClosed = true
-		fakeSnap := *snap
-		fakeSnap.refCount = 1
-		snap = &fakeSnap
+		snap = &Snapshot{db: m, sn: snap.sn, ts: snap.ts, refCount: 1, count: snap.count}
 
+		// Delta writing should be terminated even if the backup has failed
 		defer func() {
-			if err = m.changeDeltaWrState(dwStateTerminate, nil, nil); err == nil {
-				bs, _ := json.Marshal(deltaFiles)
-				err = ioutil.WriteFile(filepath.Join(deltadir, "files.json"), bs, 0660)
+			if e := m.changeDeltaWrState(dwStateTerminate, nil, nil); err == nil {
+				if err = e; err == nil {
+					err = b.commit(deltaFiles)
+				}
 			}
 		}()
 	}
@@ -983,11 +1749,18 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		return nil
 	}
 
-	manifest, _ := json.Marshal(map[string]interface{}{"version": version})
-	if err = ioutil.WriteFile(filepath.Join(manifestdir, "nitro.json"), manifest, 0660); err == nil {
-		if err = m.Visitor(snap, visitorCallback, shards, concurr); err == nil {
-			bs, _ := json.Marshal(files)
-			err = ioutil.WriteFile(filepath.Join(datadir, "files.json"), bs, 0660)
+	if incr == nil {
+		err = m.VisitorContext(ctx, snap, visitorCallback, shards, concurr)
+	} else {
+		err = m.visitShards(m.splitRange(snap, nil, nil, shards), concurr, func(shard int, startItem, endItem *Item) error {
+			return m.storeDiffShard(ctx, incr.base, snap, startItem, endItem,
+				writers[shard], deletedWriters[shard], itmCallback)
+		})
+	}
+
+	for _, kind := range kinds {
+		if err == nil {
+			err = b.commit(kind)
 		}
 	}
 
@@ -995,33 +1768,73 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 }
 
 // LoadFromDisk restores Nitro from a disk backup
+// If the backup is an incremental backup, the chain of backups starting from
+// the full backup is restored. If the write-ahead log is enabled, the logged
+// mutations are applied on top of the backup.
 func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snapshot, error) {
-	var wg sync.WaitGroup
-	var files []string
-	var bs []byte
-	var err error
-	manifestdir := dir
-	var version int
+	return m.LoadFromDiskContext(context.Background(), dir, concurr, callb)
+}
 
-	// Read file version
-	if bs, err := ioutil.ReadFile(filepath.Join(manifestdir, "nitro.json")); err == nil {
-		mMap := make(map[string]int)
-		if err = json.Unmarshal(bs, &mMap); err != nil {
+// LoadFromDiskContext is same as LoadFromDisk(). Additionally, the restore is
+// aborted once the context is cancelled and ctx.Err() is returned. The Nitro
+// instance holds a partially restored state and it should be closed.
+func (m *Nitro) LoadFromDiskContext(ctx context.Context, dir string, concurr int,
+	callb ItemCallback) (*Snapshot, error) {
+	chain, err := readBackupChain(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	p := m.startProgress(true, 0)
+	if err := m.loadBackup(ctx, chain[0], concurr, callb); err != nil {
+		return nil, err
+	}
+
+	p.setPhase(ProgressIncremental)
+	for _, incr := range chain[1:] {
+		if err := m.loadIncrementalBackup(ctx, incr, callb); err != nil {
+			return nil, err
+		}
+	}
+
+	// The write-ahead log replay updates the indexes using the writer
+	m.buildIndexes()
+
+	if m.wal != nil {
+		p.setPhase(ProgressWAL)
+		if err := m.replayWAL(ctx, m.getCurrSn()); err != nil {
 			return nil, err
 		}
-		version = mMap["version"]
-	} else if !os.IsNotExist(err) {
-		return nil, err
 	}
 
-	datadir := filepath.Join(dir, "data")
+	stats := m.store.GetStats()
+	m.itemsCount = int64(stats.NodeCount)
+	snap, err := m.NewSnapshot()
+	if err == nil {
+		p.setPhase(ProgressDone)
+	}
+
+	return snap, err
+}
+
+func (m *Nitro) loadBackup(ctx context.Context, manifest *backupManifest, concurr int, callb ItemCallback) error {
+	var wg sync.WaitGroup
+	var files []string
+	var bs []byte
+	var err error
+
+	datadir := filepath.Join(manifest.dir, "data")
 	if bs, err = ioutil.ReadFile(filepath.Join(datadir, "files.json")); err != nil {
-		return nil, err
+		return err
 	}
 	json.Unmarshal(bs, &files)
 
+	p := (*progressTracker)(atomic.LoadPointer(&m.progress))
+	counters := p.setShards(false, len(files), manifest.Shards)
+
 	var nodeCallb skiplist.NodeCallback
-	wchan := make(chan int)
+	// Workers may exit on an error. Hence, the channel should hold all the files.
+	wchan := make(chan int, len(files))
 	b := skiplist.NewBuilderWithConfig(m.newStoreConfig())
 	b.SetItemSizeFunc(ItemSize)
 	segments := make([]*skiplist.Segment, len(files))
@@ -1045,13 +1858,13 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 	for i, file := range files {
 		segments[i] = b.NewSegment()
 		segments[i].SetNodeCallback(nodeCallb)
-		r := m.newFileReader(m.fileType, version)
+		r := m.newFileReader(manifest.FileType, manifest.Version)
 		datafile := filepath.Join(datadir, file)
 		if err := r.Open(datafile); err != nil {
-			return nil, err
+			return err
 		}
 
-		readers[i] = r
+		readers[i] = &progressReader{FileReader: r, c: counters[i]}
 	}
 
 	for i := 0; i < concurr; i++ {
@@ -1063,6 +1876,11 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 				r := readers[shard]
 			loop:
 				for {
+					if isCancelled(ctx) {
+						errors[shard] = ctx.Err()
+						return
+					}
+
 					itm, err := r.ReadItem()
 					if err != nil {
 						errors[shard] = err
@@ -1072,6 +1890,10 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 					if itm == nil {
 						break loop
 					}
+
+					if itm.expiry() != 0 {
+						atomic.AddInt64(&m.ttlItems, 1)
+					}
 					segments[shard].Add(unsafe.Pointer(itm))
 				}
 			}
@@ -1086,7 +1908,7 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 
 	for _, err := range errors {
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
@@ -1097,12 +1919,15 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 		m.DeltaRestoreFailed = 0
 		m.DeltaRestored = 0
 
-		wchan := make(chan int)
-		deltadir := filepath.Join(dir, "delta")
+		deltadir := filepath.Join(manifest.dir, "delta")
 		var files []string
 		if bs, err := ioutil.ReadFile(filepath.Join(deltadir, "files.json")); err == nil {
 			json.Unmarshal(bs, &files)
 		}
+		wchan := make(chan int, len(files))
+
+		p.setPhase(ProgressDelta)
+		counters := p.setShards(true, len(files), manifest.Delta)
 
 		readers := make([]FileReader, len(files))
 		errors := make([]error, len(files))
@@ -1117,13 +1942,13 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 		}()
 
 		for i, file := range files {
-			r := m.newFileReader(m.fileType, version)
+			r := m.newFileReader(manifest.FileType, manifest.Version)
 			deltafile := filepath.Join(deltadir, file)
 			if err := r.Open(deltafile); err != nil {
-				return nil, err
+				return err
 			}
 
-			readers[i] = r
+			readers[i] = &progressReader{FileReader: r, c: counters[i]}
 		}
 
 		for i := 0; i < concurr; i++ {
@@ -1136,6 +1961,11 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 					r := readers[shard]
 				loop:
 					for {
+						if isCancelled(ctx) {
+							errors[shard] = ctx.Err()
+							return
+						}
+
 						itm, err := r.ReadItem()
 						if err != nil {
 							errors[shard] = err
@@ -1177,14 +2007,65 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 
 		for _, err := range errors {
 			if err != nil {
-				return nil, err
+				return err
 			}
 		}
 	}
 
-	stats := m.store.GetStats()
-	m.itemsCount = int64(stats.NodeCount)
-	return m.NewSnapshot()
+	return nil
+}
+
+// VerifyBackup reads all the files of a disk backup and verifies their checksums
+// It returns a BackupCorruptionError describing the corrupt file and offset.
+// Only the backups stored using ChecksumFile or CompressedFile type can be verified.
+func (m *Nitro) VerifyBackup(dir string) error {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	if manifest.FileType != ChecksumFile && manifest.FileType != CompressedFile {
+		return ErrBackupNotVerifiable
+	}
+
+	for _, subdir := range backupSubdirs {
+		var files []string
+		bs, err := ioutil.ReadFile(filepath.Join(dir, subdir, "files.json"))
+		if os.IsNotExist(err) && subdir != "data" {
+			continue
+		} else if err != nil {
+			return err
+		}
+		json.Unmarshal(bs, &files)
+
+		for _, file := range files {
+			if err := m.verifyFile(filepath.Join(dir, subdir, file), manifest); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *Nitro) verifyFile(path string, manifest *backupManifest) error {
+	r := m.newFileReader(manifest.FileType, manifest.Version)
+	if err := r.Open(path); err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for {
+		itm, err := r.ReadItem()
+		if err != nil {
+			return err
+		}
+
+		if itm == nil {
+			return nil
+		}
+		m.freeItem(itm)
+	}
 }
 
 // DumpStats returns Nitro statistics
@@ -1192,6 +2073,55 @@ func (m *Nitro) DumpStats() string {
 	return m.aggrStoreStats().String()
 }
 
+// Stats describes the state of a Nitro instance
+// Snapshots is the number of live snapshots and GCSnapshots is the number of
+// closed snapshots waiting for the garbage collector. LeastUnrefSn is the
+// lowest snapshot number waiting for the garbage collector.
+type Stats struct {
+	Store        skiplist.StatsReport `json:"store"`
+	ItemsCount   int64                `json:"items_count"`
+	Snapshots    int                  `json:"snapshots"`
+	GCSnapshots  int                  `json:"gc_snapshots"`
+	CurrSn       uint32               `json:"curr_sn"`
+	LastGCSn     uint32               `json:"last_gc_sn"`
+	LeastUnrefSn uint32               `json:"least_unref_sn"`
+	MemoryInUse  int64                `json:"memory_in_use"`
+
+	DeltaRestored      uint64 `json:"delta_restored"`
+	DeltaRestoreFailed uint64 `json:"delta_restore_failed"`
+	ItemsExpired       uint64 `json:"items_expired"`
+	SnapshotsExpired   uint64 `json:"snapshots_expired"`
+}
+
+// Stats returns the statistics of the Nitro instance
+func (m *Nitro) Stats() Stats {
+	sts := Stats{
+		Store:              m.aggrStoreStats(),
+		ItemsCount:         m.ItemsCount(),
+		Snapshots:          len(m.GetSnapshots()),
+		CurrSn:             m.getCurrSn(),
+		LastGCSn:           atomic.LoadUint32(&m.lastGCSn),
+		MemoryInUse:        m.MemoryInUse(),
+		DeltaRestored:      atomic.LoadUint64(&m.DeltaRestored),
+		DeltaRestoreFailed: atomic.LoadUint64(&m.DeltaRestoreFailed),
+		ItemsExpired:       atomic.LoadUint64(&m.ItemsExpired),
+		SnapshotsExpired:   atomic.LoadUint64(&m.SnapshotsExpired),
+	}
+
+	buf := m.gcsnapshots.MakeBuf()
+	defer m.gcsnapshots.FreeBuf(buf)
+	iter := m.gcsnapshots.NewIterator(CompareSnapshot, buf)
+	defer iter.Close()
+	for iter.SeekFirst(); iter.Valid(); iter.Next() {
+		if sts.GCSnapshots == 0 {
+			sts.LeastUnrefSn = (*Snapshot)(iter.Get()).sn
+		}
+		sts.GCSnapshots++
+	}
+
+	return sts
+}
+
 func (m *Nitro) aggrStoreStats() skiplist.StatsReport {
 	sts := m.store.GetStats()
 	for w := m.wlist; w != nil; w = w.next {
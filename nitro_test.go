@@ -18,7 +18,14 @@ import "math/rand"
 import "sync"
 import "runtime"
 import "encoding/binary"
+import "encoding/json"
+import "bytes"
+import "context"
+import "io/ioutil"
+import "path/filepath"
 import "github.com/couchbase/nitro/mm"
+import "unsafe"
+import "strings"
 
 var testConf Config
 
@@ -529,6 +536,98 @@ func TestVisitorError(t *testing.T) {
 	}
 }
 
+func TestVisitorOptions(t *testing.T) {
+	const n = 100000
+	var wg sync.WaitGroup
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	wg.Add(1)
+	doInsert(db, &wg, n, false, false)
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	key := func(v uint64) []byte {
+		bs := make([]byte, 8)
+		binary.BigEndian.PutUint64(bs, v)
+		return bs
+	}
+
+	// Unordered range visitor
+	var count, maxShard int64
+	callb := func(itm *Item, shard int) error {
+		if v := binary.BigEndian.Uint64(itm.Bytes()); v < 20000 || v >= 70000 {
+			t.Errorf("Unexpected item %d outside the range", v)
+		}
+		atomic.AddInt64(&count, 1)
+		for m := atomic.LoadInt64(&maxShard); int64(shard) > m; m = atomic.LoadInt64(&maxShard) {
+			atomic.CompareAndSwapInt64(&maxShard, m, int64(shard))
+		}
+		return nil
+	}
+
+	opts := VisitorOptions{StartKey: key(20000), EndKey: key(70000)}
+	if err := db.VisitorWithOptions(context.Background(), snap, callb, 8, 4, opts); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	if count != 50000 || maxShard == 0 {
+		t.Errorf("Expected 50000 items in multiple shards. got %d items in %d shards", count, maxShard+1)
+	}
+
+	// Ordered visitor delivers the items in key order from the caller
+	for _, opts := range []VisitorOptions{{Ordered: true}, {StartKey: key(20000), EndKey: key(70000), Ordered: true}} {
+		var items []uint64
+		lastShard := 0
+		callb := func(itm *Item, shard int) error {
+			if shard < lastShard {
+				t.Errorf("Expected shards in order. got %d after %d", shard, lastShard)
+			}
+			lastShard = shard
+			items = append(items, binary.BigEndian.Uint64(itm.Bytes()))
+			return nil
+		}
+
+		if err := db.VisitorWithOptions(context.Background(), snap, callb, 8, 4, opts); err != nil {
+			t.Fatalf("Expected no error. got=%v", err)
+		}
+
+		start, end := uint64(0), uint64(n)
+		if opts.StartKey != nil {
+			start, end = 20000, 70000
+		}
+
+		if len(items) != int(end-start) {
+			t.Fatalf("Expected %d items. got %d", end-start, len(items))
+		}
+
+		for i, v := range items {
+			if v != start+uint64(i) {
+				t.Fatalf("Expected item %d. got %d", start+uint64(i), v)
+			}
+		}
+	}
+
+	// An error stops the ordered visitor after the preceding items
+	errVisitor := fmt.Errorf("visitor failed")
+	count = 0
+	callb = func(itm *Item, shard int) error {
+		if binary.BigEndian.Uint64(itm.Bytes()) == 50000 {
+			return errVisitor
+		}
+		count++
+		return nil
+	}
+
+	if err := db.VisitorWithOptions(context.Background(), snap, callb, 8, 2, VisitorOptions{Ordered: true}); err != errVisitor {
+		t.Errorf("Expected error. got=%v", err)
+	}
+
+	if count != 50000 {
+		t.Errorf("Expected 50000 items before the error. got %d", count)
+	}
+}
+
 func doUpdate(db *Nitro, wg *sync.WaitGroup, w *Writer, start, end int, version int) {
 	defer wg.Done()
 	for ; start < end; start++ {
@@ -735,3 +834,1936 @@ func TestCloseWithActiveIterators(t *testing.T) {
 	wg.Wait()
 
 }
+
+func TestWriteBatch(t *testing.T) {
+	const batchSize = 100
+	const nbatches = 50
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < nbatches; i++ {
+			b := w.NewWriteBatch()
+			for j := 0; j < batchSize; j++ {
+				b.Put([]byte(fmt.Sprintf("%010d", i*batchSize+j)))
+			}
+			if i > 0 {
+				b.Delete([]byte(fmt.Sprintf("%010d", (i-1)*batchSize)))
+			}
+
+			expected := b.Len()
+			if applied, _ := b.Commit(); applied != expected {
+				t.Errorf("Expected %d applied, got %d", expected, applied)
+			}
+		}
+	}()
+
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+
+		snap, _ := db.NewSnapshot()
+		count := CountItems(snap)
+		batches := count / (batchSize - 1)
+		if count != 0 && count != batches*(batchSize-1)+1 {
+			t.Errorf("Snapshot observed a partial batch, count = %d", count)
+		}
+		snap.Close()
+	}
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	VerifyCount(snap, nbatches*(batchSize-1)+1, t)
+}
+
+func TestWriteBatchRollback(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+
+	for i := 0; i < 10; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	// The batch fails at the duplicate insert of item 5
+	b := w.NewWriteBatch()
+	b.Put([]byte(fmt.Sprintf("%010d", 100)))
+	b.Delete([]byte(fmt.Sprintf("%010d", 0)))
+	b.Put([]byte(fmt.Sprintf("%010d", 0)))
+	b.Delete([]byte(fmt.Sprintf("%010d", 0)))
+	b.Delete([]byte(fmt.Sprintf("%010d", 1)))
+	b.Put([]byte(fmt.Sprintf("%010d", 5)))
+	if applied, err := b.Commit(); applied != 0 || err != ErrBatchAborted {
+		t.Errorf("Expected aborted batch. got applied=%d, err=%v", applied, err)
+	}
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	VerifyCount(snap, 10, t)
+	for i := 0; i < 10; i++ {
+		if snap.Get([]byte(fmt.Sprintf("%010d", i))) == nil {
+			t.Errorf("Expected item %d to be restored", i)
+		}
+	}
+
+	if snap.Get([]byte(fmt.Sprintf("%010d", 100))) != nil {
+		t.Errorf("Expected item 100 to be rolled back")
+	}
+}
+
+func TestGet(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	for i := 0; i < 1000; i += 2 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%010d", i))
+		if got := snap1.Get(key); string(got) != string(key) {
+			t.Errorf("Expected %s in snap1, got %v", key, got)
+		}
+
+		got := snap2.Get(key)
+		if i%2 == 0 && got != nil {
+			t.Errorf("Expected %s to be deleted in snap2", key)
+		} else if i%2 != 0 && string(got) != string(key) {
+			t.Errorf("Expected %s in snap2, got %v", key, got)
+		}
+
+		if string(w.Get(key)) != string(got) {
+			t.Errorf("Writer.Get mismatch for %s", key)
+		}
+	}
+
+	if snap1.Get([]byte("missing")) != nil {
+		t.Errorf("Expected nil for a missing key")
+	}
+}
+
+func TestReverseIterator(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	for i := 0; i < 1000; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+		if i%2 == 0 {
+			w.Put([]byte(fmt.Sprintf("%010d", i)))
+		}
+	}
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	itr := snap1.NewIterator()
+	count := 0
+	for itr.SeekLast(); itr.Valid(); itr.Prev() {
+		expected := fmt.Sprintf("%010d", 999-count)
+		if got := string(itr.Get()); got != expected {
+			t.Errorf("Expected %s, got %v", expected, got)
+		}
+		count++
+	}
+	itr.Close()
+
+	if count != 1000 {
+		t.Errorf("Expected count = 1000, got %v", count)
+	}
+
+	itr = snap2.NewIterator()
+	defer itr.Close()
+	count = 0
+	for itr.SeekForPrev([]byte(fmt.Sprintf("%010d", 501))); itr.Valid(); itr.Prev() {
+		expected := fmt.Sprintf("%010d", 500-count*2)
+		if got := string(itr.Get()); got != expected {
+			t.Errorf("Expected %s, got %v", expected, got)
+		}
+		count++
+	}
+
+	if count != 251 {
+		t.Errorf("Expected count = 251, got %v", count)
+	}
+}
+
+func TestIteratorOptions(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	countRange := func(opts IteratorOptions, reverse bool) (count int) {
+		itr := snap.NewIteratorWithOptions(opts)
+		defer itr.Close()
+		if reverse {
+			for itr.SeekLast(); itr.Valid(); itr.Prev() {
+				count++
+			}
+		} else {
+			for itr.SeekFirst(); itr.Valid(); itr.Next() {
+				count++
+			}
+		}
+		return
+	}
+
+	end := []byte(fmt.Sprintf("%010d", 500))
+	for _, reverse := range []bool{false, true} {
+		if c := countRange(IteratorOptions{EndKey: end}, reverse); c != 500 {
+			t.Errorf("Expected 500 items before exclusive end, got %d", c)
+		}
+
+		if c := countRange(IteratorOptions{EndKey: end, InclusiveEnd: true}, reverse); c != 501 {
+			t.Errorf("Expected 501 items before inclusive end, got %d", c)
+		}
+
+		if c := countRange(IteratorOptions{Prefix: []byte("00000001")}, reverse); c != 100 {
+			t.Errorf("Expected 100 items with prefix, got %d", c)
+		}
+
+		opts := IteratorOptions{Prefix: []byte("00000001"), EndKey: end}
+		if c := countRange(opts, reverse); c != 100 {
+			t.Errorf("Expected 100 items with prefix before end, got %d", c)
+		}
+
+		opts = IteratorOptions{Prefix: []byte("00000001"), EndKey: []byte(fmt.Sprintf("%010d", 150))}
+		if c := countRange(opts, reverse); c != 50 {
+			t.Errorf("Expected 50 items with prefix before end, got %d", c)
+		}
+	}
+
+	itr := snap.NewIteratorWithOptions(IteratorOptions{Prefix: []byte("000000002")})
+	defer itr.Close()
+	itr.Seek([]byte("0"))
+	if !itr.Valid() || string(itr.Get()) != fmt.Sprintf("%010d", 20) {
+		t.Errorf("Expected seek to be clamped to the prefix")
+	}
+}
+
+func TestDiffIterator(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	for i := 0; i < 100; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	for i := 1000; i < 1050; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	// Short lived item should not be reported
+	w.Put([]byte(fmt.Sprintf("%010d", 2000)))
+	snap3, _ := w.NewSnapshot()
+	w.Delete([]byte(fmt.Sprintf("%010d", 2000)))
+	snap4, _ := w.NewSnapshot()
+	defer snap4.Close()
+	snap3.Close()
+
+	itr := db.NewDiffIterator(snap1, snap4)
+	defer itr.Close()
+
+	var inserts, deletes int
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		var i int
+		fmt.Sscanf(string(itr.Get()), "%d", &i)
+		switch itr.Op() {
+		case DiffInsert:
+			if i < 1000 || i >= 1050 {
+				t.Errorf("Unexpected insert of %d", i)
+			}
+			inserts++
+		case DiffDelete:
+			if i >= 100 {
+				t.Errorf("Unexpected delete of %d", i)
+			}
+			deletes++
+		}
+	}
+
+	if inserts != 50 || deletes != 100 {
+		t.Errorf("Expected 50 inserts and 100 deletes, got %d, %d", inserts, deletes)
+	}
+}
+
+func TestChangeFeed(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w1 := db.NewWriter()
+	w2 := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		w1.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap0, _ := db.NewSnapshot()
+
+	sub, err := db.Subscribe(nil, 1)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	// The stream starts from the next snapshot boundary
+	boundary, _ := db.NewSnapshot()
+	boundary.Close()
+
+	for i := 0; i < 50; i++ {
+		w2.Delete([]byte(fmt.Sprintf("%010d", i)))
+		w1.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	for i := 100; i < 110; i++ {
+		w2.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	w1.Put([]byte(fmt.Sprintf("%010d", 200)))
+	w2.Delete([]byte(fmt.Sprintf("%010d", 200)))
+
+	snap1, _ := db.NewSnapshot()
+	defer snap1.Close()
+
+	b, err := sub.Next()
+	if err != nil || b.Sn != snap1.sn {
+		t.Fatalf("Expected batch for snapshot %d, got %v %v", snap1.sn, b, err)
+	}
+
+	if len(b.Mutations) != 110 {
+		t.Errorf("Expected 110 mutations, got %d", len(b.Mutations))
+	}
+
+	for i, mut := range b.Mutations[:100] {
+		expected := DiffDelete
+		if i%2 == 1 {
+			expected = DiffInsert
+		}
+		if mut.Op != expected || string(mut.Data) != fmt.Sprintf("%010d", i/2) {
+			t.Errorf("Unexpected mutation %d: %v %s", i, mut.Op, mut.Data)
+		}
+	}
+
+	sub.Close()
+	if _, err := sub.Next(); err != ErrSubscriptionClosed {
+		t.Errorf("Expected ErrSubscriptionClosed. got=%v", err)
+	}
+
+	// Resume from an older snapshot
+	sub, err = db.Subscribe(snap0, 1)
+	snap0.Close()
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	defer sub.Close()
+
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+	if b, _ = sub.Next(); b.Sn != snap2.sn || len(b.Mutations) != 110 {
+		t.Errorf("Expected 110 catch-up mutations, got %d", len(b.Mutations))
+	}
+
+	w1.Put([]byte(fmt.Sprintf("%010d", 300)))
+	snap3, _ := db.NewSnapshot()
+	defer snap3.Close()
+	if b, _ = sub.Next(); b.Sn != snap3.sn || len(b.Mutations) != 1 {
+		t.Errorf("Expected one mutation for snapshot %d, got %v", snap3.sn, b)
+	}
+}
+
+func TestChangeFeedLagging(t *testing.T) {
+	cfg := testConf
+	cfg.SetChangeFeedTimeout(10 * time.Millisecond)
+	db := NewWithConfig(cfg)
+	defer db.Close()
+
+	sub, _ := db.Subscribe(nil, 1)
+	defer sub.Close()
+
+	// A subscriber which does not consume the batches does not block the
+	// snapshot creation
+	w := db.NewWriter()
+	for i := 0; i < 5; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+		snap, _ := db.NewSnapshot()
+		snap.Close()
+	}
+
+	var err error
+	for err == nil {
+		_, err = sub.Next()
+	}
+
+	if err != ErrSubscriptionLagging {
+		t.Errorf("Expected ErrSubscriptionLagging. got=%v", err)
+	}
+
+	// The queued batches are dropped once the subscription is closed
+	if _, err = sub.Next(); err != ErrSubscriptionLagging {
+		t.Errorf("Expected ErrSubscriptionLagging. got=%v", err)
+	}
+}
+
+func TestChangeFeedBackpressure(t *testing.T) {
+	cfg := testConf
+	cfg.UseChangeFeedBackpressure()
+	db := NewWithConfig(cfg)
+	defer db.Close()
+
+	sub, _ := db.Subscribe(nil, 1)
+	defer sub.Close()
+
+	w := db.NewWriter()
+	snap, _ := db.NewSnapshot()
+	snap.Close()
+
+	// The first batch fills the queue
+	w.Put([]byte(fmt.Sprintf("%010d", 0)))
+	snap, _ = db.NewSnapshot()
+	snap.Close()
+
+	w.Put([]byte(fmt.Sprintf("%010d", 1)))
+	snapDone := make(chan struct{})
+	go func() {
+		snap, _ := db.NewSnapshot()
+		snap.Close()
+		close(snapDone)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	putDone := make(chan struct{})
+	go func() {
+		w.Put([]byte(fmt.Sprintf("%010d", 2)))
+		close(putDone)
+	}()
+
+	// Both the snapshot creation and the writer wait for the subscriber
+	select {
+	case <-snapDone:
+		t.Fatalf("Expected NewSnapshot to wait for the subscriber")
+	case <-putDone:
+		t.Fatalf("Expected the writer to be throttled")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var keys []string
+	b, err := sub.Next()
+	if err != nil {
+		t.Fatalf("Expected a batch. got=%v", err)
+	}
+	keys = append(keys, string(b.Mutations[0].Data))
+
+	<-snapDone
+	<-putDone
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			snap, _ = db.NewSnapshot()
+			snap.Close()
+		}
+
+		b, err := sub.Next()
+		if err != nil {
+			t.Fatalf("Expected a batch. got=%v", err)
+		}
+		keys = append(keys, string(b.Mutations[0].Data))
+	}
+
+	// No mutation is dropped
+	for i, key := range keys {
+		if exp := fmt.Sprintf("%010d", i); key != exp {
+			t.Errorf("Expected %s. got %s", exp, key)
+		}
+	}
+}
+
+func TestItemExpiry(t *testing.T) {
+	conf := testConf
+	conf.UseItemExpiry(100 * time.Millisecond)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%010d", i))
+		if i%2 == 0 {
+			w.PutWithTTL(key, time.Second)
+		} else {
+			w.Put(key)
+		}
+	}
+
+	snap1, _ := db.NewSnapshot()
+	VerifyCount(snap1, 1000, t)
+
+	// Only the items inserted with a ttl store the expiry time
+	for i := 0; i < 2; i++ {
+		n := w.GetNode([]byte(fmt.Sprintf("%010d", i)))
+		expected := int(itemHeaderSize) + 10
+		if i%2 == 0 {
+			expected += itemExpirySize
+		}
+
+		if sz := ItemSize(n.Item()); sz != expected {
+			t.Errorf("Expected item size %d. got %d", expected, sz)
+		}
+	}
+
+	var buf bytes.Buffer
+	itm := (*Item)(w.GetNode([]byte(fmt.Sprintf("%010d", 0))).Item())
+	db.EncodeItem(itm, make([]byte, 4), &buf)
+	if decoded, err := db.DecodeItem(version, make([]byte, 4), &buf); err != nil ||
+		!bytes.Equal(decoded.Bytes(), itm.Bytes()) || decoded.expiry() != itm.expiry() {
+		t.Errorf("Expected decoded item with expiry. got err=%v", err)
+	}
+
+	time.Sleep(2 * time.Second)
+	snap2, _ := db.NewSnapshot()
+	VerifyCount(snap2, 500, t)
+	VerifyCount(snap1, 1000, t)
+	if snap2.Get([]byte(fmt.Sprintf("%010d", 0))) != nil || w.Get([]byte(fmt.Sprintf("%010d", 0))) != nil {
+		t.Errorf("Expected expired item to be invisible")
+	}
+
+	if w.Put2([]byte(fmt.Sprintf("%010d", 0))) == nil {
+		t.Errorf("Expected insert to replace expired item")
+	}
+
+	snap1.Close()
+	snap2.Close()
+	for atomic.LoadUint64(&db.ItemsExpired) != 500 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	snap3, _ := db.NewSnapshot()
+	VerifyCount(snap3, 501, t)
+	snap3.Close()
+
+	snap4, _ := db.NewSnapshot()
+	defer snap4.Close()
+	for db.store.GetStats().NodeCount != 501 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMemoryQuota(t *testing.T) {
+	conf := testConf
+	conf.SetMemoryQuota(1024*1024, 512*1024, 0)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	var err error
+	var n int
+	for n = 0; n < 100000; n++ {
+		if err = w.Put([]byte(fmt.Sprintf("%010d", n))); err != nil {
+			break
+		}
+	}
+
+	if err != ErrMemoryQuotaExceeded {
+		t.Fatalf("Expected ErrMemoryQuotaExceeded. got=%v", err)
+	}
+
+	snap, _ := db.NewSnapshot()
+	VerifyCount(snap, n, t)
+	snap.Close()
+
+	// Free up memory and wait for the writer to recover
+	for i := 0; i < n; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := db.NewSnapshot()
+	snap1.Close()
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+
+	// Every write path reports the quota
+	db.memQuotaTimeout = 0
+	atomic.StoreInt32(&db.quotaExceeded, 1)
+	db.memQuotaLow = 0
+	if _, err = w.Put3([]byte(fmt.Sprintf("%010d", 0))); err != ErrMemoryQuotaExceeded {
+		t.Errorf("Expected ErrMemoryQuotaExceeded from Put3. got=%v", err)
+	}
+
+	if _, err = w.PutWithTTL([]byte(fmt.Sprintf("%010d", 0)), time.Second); err != ErrMemoryQuotaExceeded {
+		t.Errorf("Expected ErrMemoryQuotaExceeded from PutWithTTL. got=%v", err)
+	}
+	db.memQuotaLow = 512 * 1024
+
+	db.memQuotaTimeout = 10 * time.Second
+	if err = w.Put([]byte(fmt.Sprintf("%010d", 0))); err != nil {
+		t.Errorf("Expected writer to recover. got=%v", err)
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	os.RemoveAll("db.base")
+	os.RemoveAll("db.incr")
+	defer os.RemoveAll("db.base")
+	defer os.RemoveAll("db.incr")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	base, _ := db.NewSnapshot()
+	base.Open()
+	defer base.Close()
+	if err := db.StoreToDisk("db.base", base, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	for i := 1000; i < 1100; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap, _ := db.NewSnapshot()
+	snap.Open()
+	if err := db.StoreToDiskIncremental("db.incr", "db.base", snap, snap, 4, nil); err != ErrInvalidBackupBase {
+		t.Errorf("Expected ErrInvalidBackupBase. got=%v", err)
+	}
+
+	var changed int64
+	callb := func(e *ItemEntry) {
+		if e.Node() == nil || e.Node().Item() != unsafe.Pointer(e.Item()) {
+			t.Errorf("Expected the node of the item")
+		}
+		atomic.AddInt64(&changed, 1)
+	}
+
+	if err := db.StoreToDiskIncremental("db.incr", "db.base", base, snap, 4, callb); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	if changed != 200 {
+		t.Errorf("Expected 200 changed items. got %d", changed)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap2, err := db2.LoadFromDisk("db.incr", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	defer snap2.Close()
+
+	VerifyCount(snap2, 1000, t)
+	itr := db2.NewIterator(snap2)
+	defer itr.Close()
+	i := 100
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if exp := fmt.Sprintf("%010d", i); string(itr.Get()) != exp {
+			t.Errorf("Expected %s, got %s", exp, itr.Get())
+		}
+		i++
+	}
+}
+
+func TestChecksumBackup(t *testing.T) {
+	os.RemoveAll("db.crc")
+	defer os.RemoveAll("db.crc")
+	defer func(sz int) { DiskBlockSize = sz }(DiskBlockSize)
+	DiskBlockSize = 1024
+
+	conf := testConf
+	conf.SetFileType(ChecksumFile)
+	db := NewWithConfig(conf)
+	defer db.Close()
+	w := db.NewWriter()
+	n := 20000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk("db.crc", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	if err := db.VerifyBackup("db.crc"); err != nil {
+		t.Errorf("Expected no error. got=%v", err)
+	}
+
+	db2 := NewWithConfig(testConf)
+	snap2, err := db2.LoadFromDisk("db.crc", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	VerifyCount(snap2, n, t)
+	snap2.Close()
+	db2.Close()
+
+	// Corrupt an item in the second block of the shard
+	file := filepath.Join("db.crc", "data", "shard-0")
+	bs, _ := ioutil.ReadFile(file)
+	if len(bs) < 2100 {
+		t.Fatalf("Expected shard with multiple blocks, got %d bytes", len(bs))
+	}
+	bs[2000]++
+	ioutil.WriteFile(file, bs, 0660)
+
+	err = db.VerifyBackup("db.crc")
+	if cerr, ok := err.(*BackupCorruptionError); !ok {
+		t.Errorf("Expected BackupCorruptionError. got=%v", err)
+	} else if cerr.File != file || cerr.Offset != 1044 {
+		t.Errorf("Unexpected corruption info %v", cerr)
+	}
+
+	db3 := NewWithConfig(testConf)
+	defer db3.Close()
+	if _, err := db3.LoadFromDisk("db.crc", 4, nil); err == nil {
+		t.Errorf("Expected load of corrupt backup to fail")
+	}
+}
+
+func TestCompressedBackup(t *testing.T) {
+	os.RemoveAll("db.raw")
+	os.RemoveAll("db.snappy")
+	defer os.RemoveAll("db.raw")
+	defer os.RemoveAll("db.snappy")
+
+	conf := testConf
+	conf.SetFileType(CompressedFile)
+	db := NewWithConfig(conf)
+	defer db.Close()
+	w := db.NewWriter()
+	n := 100000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap, _ := db.NewSnapshot()
+	snap.Open()
+	if err := db.StoreToDisk("db.snappy", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	db.fileType = RawdbFile
+	if err := db.StoreToDisk("db.raw", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	dirSize := func(dir string) (sz int64) {
+		filepath.Walk(dir, func(_ string, info os.FileInfo, _ error) error {
+			sz += info.Size()
+			return nil
+		})
+		return
+	}
+
+	if raw, compressed := dirSize("db.raw"), dirSize("db.snappy"); compressed >= raw {
+		t.Errorf("Expected compressed backup to be smaller. raw=%d, compressed=%d", raw, compressed)
+	}
+
+	if err := db.VerifyBackup("db.snappy"); err != nil {
+		t.Errorf("Expected no error. got=%v", err)
+	}
+
+	// The codec is detected from the backup manifest
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap2, err := db2.LoadFromDisk("db.snappy", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	defer snap2.Close()
+	VerifyCount(snap2, n, t)
+}
+
+func TestStoreToStream(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+	n := 100000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	var buf bytes.Buffer
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToStream(&buf, snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	bs := buf.Bytes()
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap2, err := db2.LoadFromStream(bytes.NewReader(bs), 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	defer snap2.Close()
+
+	VerifyCount(snap2, n, t)
+	itr := db2.NewIterator(snap2)
+	defer itr.Close()
+	i := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if exp := fmt.Sprintf("%010d", i); string(itr.Get()) != exp {
+			t.Fatalf("Expected %s, got %s", exp, itr.Get())
+		}
+		i++
+	}
+
+	db3 := NewWithConfig(testConf)
+	defer db3.Close()
+	if _, err := db3.LoadFromStream(bytes.NewReader(bs[:len(bs)/2]), 4, nil); err != ErrInvalidStream {
+		t.Errorf("Expected ErrInvalidStream for truncated stream. got=%v", err)
+	}
+
+	// Corrupt the shard id in the header of the first frame
+	corrupt := append([]byte(nil), bs...)
+	corrupt[len(streamMagic)+1] = 0xff
+	db4 := NewWithConfig(testConf)
+	defer db4.Close()
+	if _, err := db4.LoadFromStream(bytes.NewReader(corrupt), 4, nil); err != ErrInvalidStream {
+		t.Errorf("Expected ErrInvalidStream for corrupt header. got=%v", err)
+	}
+
+	if _, err := db4.LoadFromStream(bytes.NewReader(bs), 0, nil); err != ErrInvalidConcurrency {
+		t.Errorf("Expected ErrInvalidConcurrency. got=%v", err)
+	}
+}
+
+func TestWAL(t *testing.T) {
+	os.RemoveAll("db.wal")
+	os.RemoveAll("db.base")
+	defer os.RemoveAll("db.wal")
+	defer os.RemoveAll("db.base")
+
+	conf := testConf
+	conf.UseWAL("db.wal", WALSyncAlways, 0)
+	db := NewWithConfig(conf)
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk("db.base", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	// Mutations after the backup are recovered from the log
+	var wg sync.WaitGroup
+	for x := 0; x < 4; x++ {
+		wg.Add(1)
+		go func(x int, w *Writer) {
+			defer wg.Done()
+			// The replay of more deletes than the free list channel can
+			// buffer needs a free worker
+			for i := x * 100; i < (x+1)*100; i++ {
+				if _, ok, err := w.Delete3([]byte(fmt.Sprintf("%010d", i))); !ok || err != nil {
+					t.Errorf("Expected delete to succeed. got=%v", err)
+				}
+			}
+			for i := 1000 + x*25; i < 1000+(x+1)*25; i++ {
+				if err := w.Put([]byte(fmt.Sprintf("%010d", i))); err != nil {
+					t.Errorf("Expected no error. got=%v", err)
+				}
+			}
+		}(x, db.NewWriter())
+	}
+	wg.Wait()
+
+	b := w.NewWriteBatch()
+	b.Delete([]byte(fmt.Sprintf("%010d", 400)))
+	b.Put([]byte(fmt.Sprintf("%010d", 1100)))
+	if _, err := b.Commit(); err != nil {
+		t.Errorf("Expected no error. got=%v", err)
+	}
+	db.Close()
+
+	db = NewWithConfig(conf)
+	defer db.Close()
+	snap, err := db.LoadFromDisk("db.base", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	VerifyCount(snap, 700, t)
+	for i := 0; i <= 1100; i++ {
+		found := snap.Get([]byte(fmt.Sprintf("%010d", i))) != nil
+		if i <= 400 && found {
+			t.Errorf("Expected %d to be deleted", i)
+		} else if i > 400 && !found {
+			t.Errorf("Expected %d to be present", i)
+		}
+	}
+
+	// A new backup truncates the log
+	if err := db.StoreToDisk("db.base", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join("db.wal", "*.log")); len(files) != 1 {
+		t.Errorf("Expected log to be truncated. got %v", files)
+	}
+}
+
+func TestWALRecovery(t *testing.T) {
+	os.RemoveAll("db.wal")
+	os.RemoveAll("db.base")
+	defer os.RemoveAll("db.wal")
+	defer os.RemoveAll("db.base")
+
+	// A default sync interval is used
+	conf := testConf
+	conf.UseWAL("db.wal", WALSyncInterval, 0)
+	db := NewWithConfig(conf)
+
+	// Concurrent mutations of the same keys are replayed in the order in
+	// which they took effect
+	var wg sync.WaitGroup
+	for x := 0; x < 4; x++ {
+		wg.Add(1)
+		go func(x int, w *Writer) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := []byte(fmt.Sprintf("%010d", (i*7+x)%50))
+				if (i+x)%2 == 0 {
+					w.Put(key)
+				} else {
+					w.Delete(key)
+				}
+			}
+		}(x, db.NewWriter())
+	}
+	wg.Wait()
+
+	snap, _ := db.NewSnapshot()
+	expected := make(map[string]bool)
+	itr := snap.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		expected[string(itr.Get())] = true
+	}
+	itr.Close()
+	snap.Close()
+	db.Close()
+
+	// The log is kept by a backup of an instance which has not replayed it
+	db = NewWithConfig(conf)
+	w := db.NewWriter()
+	for i := 100; i < 150; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+		expected[fmt.Sprintf("%010d", i)] = true
+	}
+
+	snap, _ = db.NewSnapshot()
+	if err := db.StoreToDisk("db.base", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	db.Close()
+
+	db = NewWithConfig(conf)
+	defer db.Close()
+	snap, err := db.LoadFromDisk("db.base", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	defer snap.Close()
+
+	got := make(map[string]bool)
+	itr = snap.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		got[string(itr.Get())] = true
+	}
+	itr.Close()
+
+	if len(got) != len(expected) {
+		t.Errorf("Expected %d items. got %d", len(expected), len(got))
+	}
+
+	for key := range expected {
+		if !got[key] {
+			t.Errorf("Expected %s to be recovered", key)
+		}
+	}
+}
+
+func TestStoreLoadDiskContext(t *testing.T) {
+	os.RemoveAll("db.ctx")
+	defer os.RemoveAll("db.ctx")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+	n := 100000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var count int64
+	callb := func(*ItemEntry) {
+		if atomic.AddInt64(&count, 1) == 1000 {
+			cancel()
+		}
+	}
+
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDiskContext(ctx, "db.ctx", snap, 4, callb); err != context.Canceled {
+		t.Errorf("Expected context.Canceled. got=%v", err)
+	}
+
+	if count >= int64(n) {
+		t.Errorf("Expected backup to be aborted")
+	}
+
+	if _, err := os.Stat(filepath.Join("db.ctx", "data")); !os.IsNotExist(err) {
+		t.Errorf("Expected partial backup files to be removed")
+	}
+
+	snap, _ = db.NewSnapshot()
+	if err := db.StoreToDisk("db.ctx", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	if _, err := db2.LoadFromDiskContext(ctx, "db.ctx", 4, nil); err != context.Canceled {
+		t.Errorf("Expected context.Canceled. got=%v", err)
+	}
+}
+
+func TestLoadDiskContextCancelled(t *testing.T) {
+	os.RemoveAll("db.ctx")
+	defer os.RemoveAll("db.ctx")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk("db.ctx", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	// The restore has more shard files than workers
+	datadir := filepath.Join("db.ctx", "data")
+	var files []string
+	bs, _ := ioutil.ReadFile(filepath.Join(datadir, "files.json"))
+	json.Unmarshal(bs, &files)
+	for len(files) < 4 {
+		files = append(files, files[0])
+	}
+	bs, _ = json.Marshal(files)
+	ioutil.WriteFile(filepath.Join(datadir, "files.json"), bs, 0644)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan error)
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	go func() {
+		_, err := db2.LoadFromDiskContext(ctx, "db.ctx", 1, nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Expected context.Canceled. got=%v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the cancelled restore to return")
+	}
+}
+
+func TestBackupProgress(t *testing.T) {
+	os.RemoveAll("db.progress")
+	defer os.RemoveAll("db.progress")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+	n := 100000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	if p := db.GetBackupProgress(); p.Phase != ProgressIdle {
+		t.Errorf("Expected idle progress. got=%v", p.Phase)
+	}
+
+	var polled BackupProgress
+	var count int
+	callb := func(*ItemEntry) {
+		if count++; count == n/2 {
+			polled = db.GetBackupProgress()
+		}
+	}
+
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk("db.progress", snap, 4, callb); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	if polled.Restore || polled.Phase != ProgressData || polled.TotalItems != int64(n) {
+		t.Errorf("Unexpected backup progress %+v", polled)
+	}
+
+	if polled.Items < int64(n/2) || polled.Items >= int64(n) {
+		t.Errorf("Expected %d items to be processed. got=%d", n/2, polled.Items)
+	}
+
+	p := db.GetBackupProgress()
+	if p.Phase != ProgressDone || p.Items != int64(n) || p.Bytes != int64(n*10) {
+		t.Errorf("Unexpected backup progress %+v", p)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	count = 0
+	snap2, err := db2.LoadFromDisk("db.progress", 4, func(*ItemEntry) {
+		if count++; count == n/2 {
+			polled = db2.GetBackupProgress()
+		}
+	})
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	defer snap2.Close()
+
+	if !polled.Restore || polled.Phase != ProgressData ||
+		polled.TotalItems != int64(n) || polled.TotalBytes != int64(n*10) {
+		t.Errorf("Unexpected restore progress %+v", polled)
+	}
+
+	p = db2.GetBackupProgress()
+	if p.Phase != ProgressDone || p.Items != p.TotalItems || len(p.Shards) != len(polled.Shards) {
+		t.Errorf("Unexpected restore progress %+v", p)
+	}
+
+	for i, sp := range p.Shards {
+		if sp.Items != sp.TotalItems || sp.Bytes != sp.TotalBytes {
+			t.Errorf("Shard %d is incomplete %+v", i, sp)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	n := 1000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap1, _ := db.NewSnapshot()
+	snap2, _ := db.NewSnapshot()
+	snap3, _ := db.NewSnapshot()
+	snap2.Close()
+
+	sts := db.Stats()
+	if sts.ItemsCount != int64(n) || sts.Store.NodeCount != n {
+		t.Errorf("Expected %d items. got=%d, %d", n, sts.ItemsCount, sts.Store.NodeCount)
+	}
+
+	if sts.Snapshots != 2 || sts.GCSnapshots != 1 {
+		t.Errorf("Expected 2 live and 1 gc snapshots. got=%d, %d", sts.Snapshots, sts.GCSnapshots)
+	}
+
+	if sts.LastGCSn != 0 || sts.LeastUnrefSn != snap2.sn || sts.CurrSn != snap3.sn+1 {
+		t.Errorf("Unexpected snapshot numbers %+v", sts)
+	}
+
+	if sts.MemoryInUse != db.MemoryInUse() {
+		t.Errorf("Expected memory in use %d. got=%d", db.MemoryInUse(), sts.MemoryInUse)
+	}
+
+	snap1.Close()
+	snap3.Close()
+	sts = db.Stats()
+	if sts.Snapshots != 0 || sts.GCSnapshots != 0 || sts.LastGCSn != snap3.sn {
+		t.Errorf("Expected all snapshots to be collected %+v", sts)
+	}
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	os.RemoveAll("db.index")
+	defer os.RemoveAll("db.index")
+
+	// Items are keyed by the first 5 bytes and indexed by the last 5 bytes
+	cfg := testConf
+	cfg.AddIndex("value", func(itm []byte) []byte {
+		return itm[5:]
+	}, bytes.Compare)
+
+	db := NewWithConfig(cfg)
+	defer db.Close()
+
+	n := 1000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%05d%05d", i, n-i)))
+	}
+	snap1, _ := db.NewSnapshot()
+
+	idxMem := db.getIndex("value").store.MemoryInUse()
+	if storeMem := db.aggrStoreStats().Memory; idxMem == 0 || db.MemoryInUse() < storeMem+idxMem {
+		t.Errorf("Expected memory in use to include the index. got=%d", db.MemoryInUse())
+	}
+
+	for i := 0; i < n; i += 2 {
+		w.Delete([]byte(fmt.Sprintf("%05d%05d", i, n-i)))
+	}
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+
+	verify := func(snap *Snapshot, step int) {
+		itr := snap.NewIndexIterator("value")
+		defer itr.Close()
+
+		count := 0
+		prev := []byte("")
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			if bytes.Compare(itr.Key(), prev) <= 0 {
+				t.Errorf("Expected index order. got %s after %s", itr.Key(), prev)
+			}
+			prev = itr.Key()
+			count++
+			if count%100 == 0 {
+				itr.Refresh()
+			}
+		}
+
+		if count != n/step {
+			t.Errorf("Expected %d items. got=%d", n/step, count)
+		}
+
+		// The item with the index key has been deleted if step is 2
+		i := n/2 - (step - 1)
+		itr.Seek([]byte(fmt.Sprintf("%05d", n/2)))
+		if !itr.Valid() || string(itr.Get()) != fmt.Sprintf("%05d%05d", i, n-i) {
+			t.Errorf("Unexpected seek result %s", itr.Get())
+		}
+	}
+
+	verify(snap1, 1)
+	snap1.Close()
+	db.GC()
+	verify(snap2, 2)
+
+	snap2.Open()
+	if err := db.StoreToDisk("db.index", snap2, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	db2 := NewWithConfig(cfg)
+	defer db2.Close()
+	snap3, err := db2.LoadFromDisk("db.index", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	defer snap3.Close()
+	verify(snap3, 2)
+}
+
+func TestConditionalWrites(t *testing.T) {
+	// Items are keyed by the first 4 bytes
+	cfg := testConf
+	cfg.SetKeyComparator(func(a, b []byte) int {
+		return bytes.Compare(a[:4], b[:4])
+	})
+
+	db := NewWithConfig(cfg)
+	defer db.Close()
+
+	w := db.NewWriter()
+	if ok, _ := w.Replace([]byte("key1val1")); ok {
+		t.Errorf("Expected replace of a missing item to fail")
+	}
+
+	if ok, _ := w.PutIfAbsent([]byte("key1val1")); !ok {
+		t.Errorf("Expected insert to succeed")
+	}
+
+	if ok, _ := w.PutIfAbsent([]byte("key1val2")); ok {
+		t.Errorf("Expected insert of an existing item to fail")
+	}
+
+	// Old item is replaced within the same snapshot
+	if ok, _ := w.Replace([]byte("key1val2")); !ok || string(w.Get([]byte("key1"))) != "key1val2" {
+		t.Errorf("Expected replace to succeed. got=%s", w.Get([]byte("key1")))
+	}
+
+	snap1, _ := db.NewSnapshot()
+	defer snap1.Close()
+
+	if ok, _ := w.Replace([]byte("key1val3")); !ok || string(w.Get([]byte("key1"))) != "key1val3" {
+		t.Errorf("Expected replace to succeed. got=%s", w.Get([]byte("key1")))
+	}
+
+	if ok, _ := w.CompareAndDelete([]byte("key1val2")); ok {
+		t.Errorf("Expected delete of a mismatching item to fail")
+	}
+
+	if ok, _ := w.CompareAndDelete([]byte("key1val3")); !ok || w.Get([]byte("key1")) != nil {
+		t.Errorf("Expected delete to succeed")
+	}
+
+	if string(snap1.Get([]byte("key1"))) != "key1val2" {
+		t.Errorf("Expected snapshot to retain the replaced item. got=%s", snap1.Get([]byte("key1")))
+	}
+
+	// Concurrent conditional writers on the same key
+	nw := 8
+	var inserts, deletes int64
+	var wg sync.WaitGroup
+	writers := make([]*Writer, nw)
+	for i := range writers {
+		writers[i] = db.NewWriter()
+	}
+
+	for round := 0; round < 10; round++ {
+		for i := 0; i < nw; i++ {
+			wg.Add(1)
+			go func(w *Writer, id int) {
+				defer wg.Done()
+				if ok, _ := w.PutIfAbsent([]byte("key2init")); ok {
+					atomic.AddInt64(&inserts, 1)
+				}
+
+				for j := 0; j < 100; j++ {
+					w.Replace([]byte(fmt.Sprintf("key2%04d", id*100+j)))
+				}
+
+				if ok, _ := w.CompareAndDelete([]byte(fmt.Sprintf("key2%04d", id*100+99))); ok {
+					atomic.AddInt64(&deletes, 1)
+				}
+			}(writers[i], i)
+		}
+		wg.Wait()
+
+		if v := w.Get([]byte("key2")); (v == nil) != (inserts == deletes) {
+			t.Errorf("Round %d: inserts %d, deletes %d and item %s", round, inserts, deletes, v)
+		}
+
+		if v := w.Get([]byte("key2")); v != nil {
+			if ok, _ := w.CompareAndDelete(v); !ok {
+				t.Errorf("Expected delete of the current item to succeed")
+			}
+		}
+		inserts, deletes = 0, 0
+
+		snap, _ := db.NewSnapshot()
+		snap.Close()
+	}
+
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+	if snap2.Count() != 0 {
+		t.Errorf("Expected no items. got=%d", snap2.Count())
+	}
+}
+
+func TestHashIndex(t *testing.T) {
+	os.RemoveAll("db.hash")
+	defer os.RemoveAll("db.hash")
+
+	cfg := testConf
+	cfg.UseHashIndex(nil)
+	db := NewWithConfig(cfg)
+	defer db.Close()
+
+	n := 1000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := db.NewSnapshot()
+
+	for i := 0; i < n; i += 2 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := db.NewSnapshot()
+
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%010d", i))
+		node := w.GetNode(key)
+		if i%2 == 0 {
+			if node != nil || w.Get(key) != nil || snap2.Get(key) != nil {
+				t.Errorf("Expected deleted item %s to be invisible", key)
+			}
+			if snap1.Get(key) == nil {
+				t.Errorf("Expected deleted item %s to be visible to the older snapshot", key)
+			}
+		} else if node == nil || !bytes.Equal((*Item)(node.Item()).Bytes(), key) {
+			t.Errorf("Expected node of item %s", key)
+		}
+	}
+
+	// StoreToDisk closes snap2. The deleted items are then removed from the
+	// hash index by the GC
+	snap1.Close()
+	if err := db.StoreToDisk("db.hash", snap2, 4, nil); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for db.store.GetStats().NodeCount != n/2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d items after GC. got %d", n/2, db.store.GetStats().NodeCount)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	hashMem := db.hashIndex.memoryInUse()
+	if hashMem == 0 || db.MemoryInUse() < db.aggrStoreStats().Memory+hashMem {
+		t.Errorf("Expected hash index memory to be reported. got %d", hashMem)
+	}
+
+	db2 := NewWithConfig(cfg)
+	defer db2.Close()
+	snap, err := db2.LoadFromDisk("db.hash", 4, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer snap.Close()
+
+	if mem := db2.hashIndex.memoryInUse(); mem != hashMem {
+		t.Errorf("Expected restored hash index memory %d. got %d", hashMem, mem)
+	}
+
+	w2 := db2.NewWriter()
+	for i := 1; i < n; i += 2 {
+		key := []byte(fmt.Sprintf("%010d", i))
+		if db2.lookupNode(key) == nil || w2.Get(key) == nil {
+			t.Errorf("Expected restored item %s in the hash index", key)
+		}
+	}
+}
+
+func TestSnapshotLease(t *testing.T) {
+	cfg := testConf
+	cfg.SetSnapshotLease(50 * time.Millisecond)
+	cfg.TrackSnapshots()
+	db := NewWithConfig(cfg)
+	defer db.Close()
+
+	n := 1000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	leaked, _ := db.NewSnapshot()
+	pinned, _ := db.NewSnapshotWithLease(0)
+	leaked.Open()
+
+	snaps := db.GetSnapshots()
+	if len(snaps) != 2 || snaps[0] != leaked {
+		t.Fatalf("Expected the leaked snapshot to be live. got %v", snaps)
+	}
+
+	if snaps[0].RefCount() != 2 || snaps[0].Age() <= 0 ||
+		!strings.Contains(snaps[0].Stack(), "TestSnapshotLease") {
+		t.Errorf("Unexpected snapshot info %d %v %s", snaps[0].RefCount(), snaps[0].Age(), snaps[0].Stack())
+	}
+
+	for i := 0; i < n; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	snap, _ := db.NewSnapshot()
+
+	if !leaked.Expired() || leaked.RefCount() != 0 || leaked.Open() {
+		t.Errorf("Expected the snapshot to be expired")
+	}
+
+	if pinned.Expired() {
+		t.Errorf("Expected the snapshot without lease not to expire")
+	}
+
+	if sts := db.Stats(); sts.SnapshotsExpired != 1 || sts.Snapshots != 2 {
+		t.Errorf("Unexpected stats %+v", sts)
+	}
+
+	// Closing an expired snapshot has no effect
+	leaked.Close()
+	leaked.Close()
+	pinned.Close()
+	snap.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for db.store.GetStats().NodeCount != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the deleted items to be collected. got %d", db.store.GetStats().NodeCount)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSnapshotLeaseScan(t *testing.T) {
+	cfg := testConf
+	cfg.SetSnapshotLease(10 * time.Millisecond)
+	db := NewWithConfig(cfg)
+	defer db.Close()
+
+	n := 1000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap, _ := db.NewSnapshot()
+	for i := 0; i < n; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	// The lease ends while the snapshot is being visited
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(2 * time.Millisecond):
+				s, _ := db.NewSnapshot()
+				s.Close()
+			}
+		}
+	}()
+
+	var count int64
+	err := db.Visitor(snap, func(itm *Item, shard int) error {
+		if atomic.AddInt64(&count, 1)%100 == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return nil
+	}, 8, 1)
+	close(stop)
+	<-done
+
+	if err != nil || count != int64(n) {
+		t.Errorf("Expected %d items. got %d err=%v", n, count, err)
+	}
+
+	if snap.Expired() {
+		t.Errorf("Expected the snapshot not to expire during the scan")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	s, _ := db.NewSnapshot()
+	defer s.Close()
+	if !snap.Expired() {
+		t.Errorf("Expected the snapshot to expire after the scan")
+	}
+
+	if err := db.Visitor(snap, func(*Item, int) error { return nil }, 8, 1); err != ErrSnapshotClosed {
+		t.Errorf("Expected ErrSnapshotClosed. got=%v", err)
+	}
+}
+
+func TestApproxCount(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	n := 100000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := db.NewSnapshot()
+	defer snap1.Close()
+
+	for i := 0; i < n/2; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+
+	within := func(v, exp, tolerance int64) bool {
+		return v >= exp-tolerance && v <= exp+tolerance
+	}
+
+	if c := db.ApproxCount(snap1, nil, nil); !within(c, int64(n), int64(n)*3/10) {
+		t.Errorf("Expected about %d items. got %d", n, c)
+	}
+
+	if c := db.ApproxCount(snap2, nil, nil); !within(c, int64(n/2), int64(n/2)*3/10) {
+		t.Errorf("Expected about %d items. got %d", n/2, c)
+	}
+
+	lo, hi := []byte(fmt.Sprintf("%010d", 60000)), []byte(fmt.Sprintf("%010d", 60100))
+	if c := db.ApproxCount(snap2, lo, hi); c != 100 {
+		t.Errorf("Expected exact count of a small range. got %d", c)
+	}
+
+	lo, hi = []byte(fmt.Sprintf("%010d", 100)), []byte(fmt.Sprintf("%010d", 200))
+	if c := db.ApproxCount(snap1, lo, hi); c != 100 {
+		t.Errorf("Expected 100 items in the old snapshot. got %d", c)
+	}
+
+	if c := db.ApproxCount(snap2, lo, hi); c != 0 {
+		t.Errorf("Expected deleted items not to be counted. got %d", c)
+	}
+
+	keys := db.ApproxQuantiles(snap2, 4)
+	if len(keys) != 3 {
+		t.Fatalf("Expected 3 quantiles. got %d", len(keys))
+	}
+
+	for i, key := range keys {
+		var k int
+		fmt.Sscanf(string(key), "%d", &k)
+		if exp := n/2 + (i+1)*n/8; !within(int64(k), int64(exp), int64(n/10)) {
+			t.Errorf("Expected quantile %d near %d. got %d", i, exp, k)
+		}
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap3, _ := db2.NewSnapshot()
+	defer snap3.Close()
+	if db2.ApproxCount(snap3, nil, nil) != 0 || len(db2.ApproxQuantiles(snap3, 4)) != 0 {
+		t.Errorf("Expected no items")
+	}
+}
+
+func TestMergeIterator(t *testing.T) {
+	// Items are keyed by the first 10 bytes
+	cfg := testConf
+	cfg.SetKeyComparator(func(a, b []byte) int {
+		return bytes.Compare(a[:10], b[:10])
+	})
+
+	n := 3000
+	var iters []*Iterator
+	for x := 0; x < 3; x++ {
+		db := NewWithConfig(cfg)
+		defer db.Close()
+		w := db.NewWriter()
+		for i := 0; i < n; i++ {
+			// Every 10th key is present in all the instances
+			if i%3 == x || i%10 == 0 {
+				w.Put([]byte(fmt.Sprintf("%010d-%d", i, x)))
+			}
+		}
+
+		snap, _ := db.NewSnapshot()
+		iters = append(iters, snap.NewIterator())
+		snap.Close()
+	}
+
+	mit := NewMergeIterator(iters, nil)
+	defer mit.Close()
+
+	count := 0
+	prev := ""
+	for mit.SeekFirst(); mit.Valid(); mit.Next() {
+		if curr := string(mit.Get()); curr <= prev {
+			t.Fatalf("Expected merged order. got %s after %s", curr, prev)
+		} else {
+			prev = curr
+		}
+		count++
+	}
+
+	if exp := n + 2*n/10; count != exp {
+		t.Errorf("Expected %d items. got %d", exp, count)
+	}
+
+	// The last instance wins and the keys divisible by 20 are skipped
+	resolve := func(itms [][]byte) int {
+		var k int
+		fmt.Sscanf(string(itms[0][:10]), "%d", &k)
+		if k%20 == 0 {
+			return -1
+		}
+		return len(itms) - 1
+	}
+
+	mit = NewMergeIterator(iters, resolve)
+
+	var expected []string
+	for k := 1000; k < n; k++ {
+		if k%20 == 0 {
+			continue
+		}
+
+		x := k % 3
+		if k%10 == 0 {
+			x = 2
+		}
+		expected = append(expected, fmt.Sprintf("%010d-%d", k, x))
+	}
+
+	i := 0
+	for mit.Seek([]byte(fmt.Sprintf("%010d", 1000))); mit.Valid(); mit.Next() {
+		if i >= len(expected) || string(mit.Get()) != expected[i] {
+			t.Fatalf("Unexpected item %s at %d", mit.Get(), i)
+		}
+		i++
+	}
+
+	if i != len(expected) {
+		t.Errorf("Expected %d items. got %d", len(expected), i)
+	}
+}
+
+func TestPartitionedNitro(t *testing.T) {
+	os.RemoveAll("db.partitioned")
+	defer os.RemoveAll("db.partitioned")
+
+	bounds := [][]byte{[]byte("0000002500"), []byte("0000005000"), []byte("0000007500")}
+	db := NewPartitioned(testConf, bounds)
+	defer db.Close()
+
+	n := 10000
+	var wg sync.WaitGroup
+	for x := 0; x < 4; x++ {
+		wg.Add(1)
+		go func(x int, w *PartitionedWriter) {
+			defer wg.Done()
+			for i := x; i < n; i += 4 {
+				if err := w.Put([]byte(fmt.Sprintf("%010d", i))); err != nil {
+					t.Errorf("Expected no error. got=%v", err)
+				}
+			}
+		}(x, db.NewWriter())
+	}
+	wg.Wait()
+
+	w := db.NewWriter()
+	for i := 0; i < n; i += 10 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap, _ := db.NewSnapshot()
+	if snap.Count() != int64(n-n/10) {
+		t.Errorf("Expected %d items. got %d", n-n/10, snap.Count())
+	}
+
+	for i, p := range db.Partitions() {
+		if c := p.ItemsCount(); c != int64(n/4-n/40) {
+			t.Errorf("Expected %d items in partition %d. got %d", n/4-n/40, i, c)
+		}
+	}
+
+	verify := func(snap *PartitionedSnapshot) {
+		itr := snap.NewIterator()
+		defer itr.Close()
+
+		i := 1
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			if exp := fmt.Sprintf("%010d", i); string(itr.Get()) != exp {
+				t.Fatalf("Expected %s. got %s", exp, itr.Get())
+			}
+			if i++; i%10 == 0 {
+				i++
+			}
+		}
+
+		if i != n+1 {
+			t.Errorf("Expected to iterate until %d. got %d", n, i)
+		}
+
+		// Seek to a deleted key at the end of a partition crosses into the next one
+		itr.Seek([]byte("0000002499"))
+		for _, exp := range []string{"0000002499", "0000002501"} {
+			if !itr.Valid() || string(itr.Get()) != exp {
+				t.Errorf("Expected %s. got %s", exp, itr.Get())
+			}
+			itr.Next()
+		}
+
+		count := 0
+		for itr.SeekLast(); itr.Valid(); itr.Prev() {
+			count++
+		}
+
+		if count != n-n/10 {
+			t.Errorf("Expected %d items in reverse. got %d", n-n/10, count)
+		}
+
+		if snap.Get([]byte("0000005001")) == nil || snap.Get([]byte("0000005000")) != nil {
+			t.Errorf("Unexpected lookup result")
+		}
+	}
+
+	verify(snap)
+	if err := db.StoreToDisk("db.partitioned", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join("db.partitioned", "partition-3", "nitro.json")); err != nil {
+		t.Errorf("Expected a backup of the last partition. got=%v", err)
+	}
+
+	db2 := NewPartitioned(testConf, bounds)
+	defer db2.Close()
+	snap2, err := db2.LoadFromDisk("db.partitioned", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	defer snap2.Close()
+	verify(snap2)
+
+	db3 := NewPartitioned(testConf, bounds[:2])
+	defer db3.Close()
+	if _, err := db3.LoadFromDisk("db.partitioned", 4, nil); err != ErrPartitionMismatch {
+		t.Errorf("Expected ErrPartitionMismatch. got=%v", err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	db := NewWithConfig(testConf)
+
+	n := 10000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%010d", i))
+		if i%10 == 0 {
+			w.PutWithTTL(key, time.Hour)
+		} else {
+			w.Put(key)
+		}
+	}
+
+	snap1, _ := db.NewSnapshot()
+	for i := 0; i < n; i += 2 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := db.NewSnapshot()
+
+	// The clone holds only the items visible in the older snapshot
+	clone, err := db.Clone(snap1, 4)
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	defer clone.Close()
+	snap1.Close()
+
+	if clone.ItemsCount() != int64(n) {
+		t.Errorf("Expected %d items. got %d", n, clone.ItemsCount())
+	}
+
+	if clone.ttlItems != int64(n/10) {
+		t.Errorf("Expected %d items with expiry. got %d", n/10, clone.ttlItems)
+	}
+
+	var expected []string
+	cw := clone.NewWriter()
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("%010d", i)
+		if i%3 == 0 {
+			cw.Delete([]byte(key))
+		} else {
+			expected = append(expected, key)
+		}
+	}
+	cw.Put([]byte("new-item"))
+	expected = append(expected, "new-item")
+
+	csnap, _ := clone.NewSnapshot()
+	defer csnap.Close()
+
+	// Mutations of the clone and the source do not affect each other
+	if got := snap2.Count(); got != int64(n/2) {
+		t.Errorf("Expected %d items in the source. got %d", n/2, got)
+	}
+	snap2.Close()
+	db.Close()
+
+	var got []string
+	itr := csnap.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		got = append(got, string(itr.Get()))
+	}
+	itr.Close()
+
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %d items in the clone. got %d", len(expected), len(got))
+	}
+
+	if _, err := clone.Clone(csnap, 0); err != ErrInvalidConcurrency {
+		t.Errorf("Expected ErrInvalidConcurrency. got=%v", err)
+	}
+}
+
+func TestPartitionedSnapshotConsistency(t *testing.T) {
+	db := NewPartitioned(testConf, [][]byte{[]byte("b")})
+	defer db.Close()
+
+	// Every item of the second partition is inserted after the item with
+	// the same number in the first partition
+	n := 20000
+	done := make(chan struct{})
+	go func(w *PartitionedWriter) {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			w.Put([]byte(fmt.Sprintf("a-%010d", i)))
+			w.Put([]byte(fmt.Sprintf("b-%010d", i)))
+		}
+	}(db.NewWriter())
+
+	for stop, failed := false, false; !stop && !failed; {
+		select {
+		case <-done:
+			stop = true
+		default:
+		}
+
+		snap, _ := db.NewSnapshot()
+		itr := snap.NewIterator()
+		itr.SeekLast()
+		if itr.Valid() && bytes.HasPrefix(itr.Get(), []byte("b-")) {
+			if key := append([]byte("a"), itr.Get()[1:]...); snap.Get(key) == nil {
+				t.Errorf("Expected %s to be visible along with %s", key, itr.Get())
+				failed = true
+			}
+		}
+		itr.Close()
+		snap.Close()
+		runtime.Gosched()
+	}
+	<-done
+}
+
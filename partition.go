@@ -0,0 +1,397 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ErrPartitionMismatch means a backup was taken using different partition boundaries
+var ErrPartitionMismatch = fmt.Errorf("Partition boundaries do not match the backup")
+
+const partitionsFile = "partitions.json"
+
+// PartitionedNitro splits the items into range partitions by their keys
+// Each partition is a separate Nitro instance with its own skiplist. Hence,
+// the writers inserting into different partitions do not contend with each
+// other. Snapshots and iterators span all the partitions.
+type PartitionedNitro struct {
+	bounds [][]byte
+	keyCmp KeyCompare
+	parts  []*Nitro
+
+	wlock   sync.Mutex
+	writers []*PartitionedWriter
+}
+
+// NewPartitioned creates a Nitro instance with len(bounds)+1 range partitions
+// Partition i holds the items whose keys are in the range [bounds[i-1], bounds[i]).
+// The bounds should be sorted as per the key comparator. If the write-ahead
+// log is enabled, each partition logs into a sub-directory of the log directory.
+func NewPartitioned(cfg Config, bounds [][]byte) *PartitionedNitro {
+	for i := 1; i < len(bounds); i++ {
+		if cfg.keyCmp(bounds[i-1], bounds[i]) >= 0 {
+			panic(fmt.Sprintf("Partition bounds are not sorted at %d", i))
+		}
+	}
+
+	m := &PartitionedNitro{
+		bounds: bounds,
+		keyCmp: cfg.keyCmp,
+	}
+
+	walDir := cfg.walDir
+	for i := 0; i <= len(bounds); i++ {
+		if walDir != "" {
+			cfg.walDir = filepath.Join(walDir, partitionName(i))
+		}
+		m.parts = append(m.parts, NewWithConfig(cfg))
+	}
+
+	return m
+}
+
+func partitionName(i int) string {
+	return fmt.Sprintf("partition-%d", i)
+}
+
+// partition returns the partition which holds the key
+func (m *PartitionedNitro) partition(bs []byte) int {
+	return sort.Search(len(m.bounds), func(i int) bool {
+		return m.keyCmp(bs, m.bounds[i]) < 0
+	})
+}
+
+// Partitions returns the Nitro instances of the partitions in the key order
+// They can be used to obtain the statistics of the partitions.
+func (m *PartitionedNitro) Partitions() []*Nitro {
+	return m.parts
+}
+
+// ItemsCount returns the number of items in all the partitions
+func (m *PartitionedNitro) ItemsCount() (count int64) {
+	for _, p := range m.parts {
+		count += p.ItemsCount()
+	}
+
+	return
+}
+
+// MemoryInUse returns the memory used by all the partitions
+func (m *PartitionedNitro) MemoryInUse() (sz int64) {
+	for _, p := range m.parts {
+		sz += p.MemoryInUse()
+	}
+
+	return
+}
+
+// Close shuts down all the partitions
+func (m *PartitionedNitro) Close() {
+	for _, p := range m.parts {
+		p.Close()
+	}
+}
+
+// PartitionedWriter routes the mutations to the writers of the partitions
+// The writer holds its lock while a mutation is applied so that NewSnapshot()
+// can pause all the writers. As a writer is used by a single goroutine, the
+// lock is contended only by NewSnapshot().
+type PartitionedWriter struct {
+	sync.Mutex
+	m       *PartitionedNitro
+	writers []*Writer
+}
+
+// NewWriter creates a writer for every partition
+func (m *PartitionedNitro) NewWriter() *PartitionedWriter {
+	w := &PartitionedWriter{m: m}
+	for _, p := range m.parts {
+		w.writers = append(w.writers, p.NewWriter())
+	}
+
+	m.wlock.Lock()
+	m.writers = append(m.writers, w)
+	m.wlock.Unlock()
+
+	return w
+}
+
+// WriterFor returns the writer of the partition which holds the key
+// It can be used for the Writer APIs which are not provided by PartitionedWriter.
+// The mutations performed using it are not paused by NewSnapshot().
+func (w *PartitionedWriter) WriterFor(bs []byte) *Writer {
+	return w.writers[w.m.partition(bs)]
+}
+
+// Put inserts an item into its partition. It is same as Writer.Put().
+func (w *PartitionedWriter) Put(bs []byte) error {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.WriterFor(bs).Put(bs)
+}
+
+// Delete deletes an item from its partition. It is same as Writer.Delete().
+func (w *PartitionedWriter) Delete(bs []byte) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.WriterFor(bs).Delete(bs)
+}
+
+// Get returns the data of the latest live item which matches the given key
+func (w *PartitionedWriter) Get(bs []byte) []byte {
+	return w.WriterFor(bs).Get(bs)
+}
+
+// PartitionedSnapshot is a snapshot of all the partitions
+// Each partition has its own snapshot number. The snapshots of the partitions
+// are created while the PartitionedWriter mutations are paused. Hence, they
+// are consistent with each other: a mutation is visible only if every
+// mutation which had returned before it started is also visible.
+type PartitionedSnapshot struct {
+	m     *PartitionedNitro
+	snaps []*Snapshot
+}
+
+// NewSnapshot creates a snapshot of every partition
+// The PartitionedWriter mutations are paused until the snapshots of all the
+// partitions have been created. The mutations performed using the partition
+// writers or instances directly are not paused. Similar to
+// Nitro.NewSnapshot(), this is a thread-unsafe API.
+func (m *PartitionedNitro) NewSnapshot() (*PartitionedSnapshot, error) {
+	m.wlock.Lock()
+	defer m.wlock.Unlock()
+
+	for _, w := range m.writers {
+		w.Lock()
+		defer w.Unlock()
+	}
+
+	snap := &PartitionedSnapshot{m: m}
+	for _, p := range m.parts {
+		s, err := p.NewSnapshot()
+		if err != nil {
+			snap.Close()
+			return nil, err
+		}
+		snap.snaps = append(snap.snaps, s)
+	}
+
+	return snap, nil
+}
+
+// Snapshots returns the snapshots of the partitions in the key order
+func (s *PartitionedSnapshot) Snapshots() []*Snapshot {
+	return s.snaps
+}
+
+// Count returns the number of items in the snapshot
+func (s *PartitionedSnapshot) Count() (count int64) {
+	for _, snap := range s.snaps {
+		count += snap.Count()
+	}
+
+	return
+}
+
+// Open adds a reference to the snapshot of every partition
+func (s *PartitionedSnapshot) Open() bool {
+	for i, snap := range s.snaps {
+		if !snap.Open() {
+			for _, snap := range s.snaps[:i] {
+				snap.Close()
+			}
+			return false
+		}
+	}
+
+	return true
+}
+
+// Close releases a reference to the snapshot of every partition
+func (s *PartitionedSnapshot) Close() {
+	for _, snap := range s.snaps {
+		snap.Close()
+	}
+}
+
+// Get returns the data of the item visible in the snapshot which matches the
+// given key. It is same as Snapshot.Get().
+func (s *PartitionedSnapshot) Get(bs []byte) []byte {
+	return s.snaps[s.m.partition(bs)].Get(bs)
+}
+
+// PartitionedIterator iterates the items of all the partitions of a snapshot
+// in the key order. The partitions are visited one after the other as their
+// key ranges do not overlap.
+type PartitionedIterator struct {
+	m     *PartitionedNitro
+	iters []*Iterator
+	curr  int
+}
+
+// NewIterator creates an iterator for the snapshot
+func (s *PartitionedSnapshot) NewIterator() *PartitionedIterator {
+	it := &PartitionedIterator{m: s.m}
+	for _, snap := range s.snaps {
+		itr := snap.NewIterator()
+		if itr == nil {
+			it.Close()
+			return nil
+		}
+		it.iters = append(it.iters, itr)
+	}
+
+	return it
+}
+
+// skipForward moves to the first item of the next non-empty partition
+func (it *PartitionedIterator) skipForward() {
+	for !it.iters[it.curr].Valid() && it.curr < len(it.iters)-1 {
+		it.curr++
+		it.iters[it.curr].SeekFirst()
+	}
+}
+
+// skipBackward moves to the last item of the previous non-empty partition
+func (it *PartitionedIterator) skipBackward() {
+	for !it.iters[it.curr].Valid() && it.curr > 0 {
+		it.curr--
+		it.iters[it.curr].SeekLast()
+	}
+}
+
+// SeekFirst moves cursor to the beginning
+func (it *PartitionedIterator) SeekFirst() {
+	it.curr = 0
+	it.iters[it.curr].SeekFirst()
+	it.skipForward()
+}
+
+// Seek to the first item with the key or the next bigger one
+func (it *PartitionedIterator) Seek(bs []byte) {
+	it.curr = it.m.partition(bs)
+	it.iters[it.curr].Seek(bs)
+	it.skipForward()
+}
+
+// SeekLast moves cursor to the last item
+func (it *PartitionedIterator) SeekLast() {
+	it.curr = len(it.iters) - 1
+	it.iters[it.curr].SeekLast()
+	it.skipBackward()
+}
+
+// Valid returns false when the iterator has reached the end
+func (it *PartitionedIterator) Valid() bool {
+	return it.iters[it.curr].Valid()
+}
+
+// Get returns the current item data from the iterator
+func (it *PartitionedIterator) Get() []byte {
+	return it.iters[it.curr].Get()
+}
+
+// Next moves iterator cursor to the next item
+func (it *PartitionedIterator) Next() {
+	it.iters[it.curr].Next()
+	it.skipForward()
+}
+
+// Prev moves iterator cursor to the previous item
+func (it *PartitionedIterator) Prev() {
+	it.iters[it.curr].Prev()
+	it.skipBackward()
+}
+
+// Close executes destructor for iterator
+func (it *PartitionedIterator) Close() {
+	for _, itr := range it.iters {
+		itr.Close()
+	}
+}
+
+// StoreToDisk backups the snapshot of every partition into a sub-directory
+// of dir using Nitro.StoreToDisk(). The partition boundaries are recorded
+// along with the backups. The snapshot is closed once the backup completes.
+func (m *PartitionedNitro) StoreToDisk(dir string, snap *PartitionedSnapshot, concurr int,
+	itmCallback ItemCallback) (err error) {
+	// A failed backup should not be restored using the older boundaries file
+	os.Remove(filepath.Join(dir, partitionsFile))
+
+	for i, p := range m.parts {
+		if err != nil {
+			snap.snaps[i].Close()
+			continue
+		}
+
+		err = p.StoreToDisk(filepath.Join(dir, partitionName(i)), snap.snaps[i], concurr, itmCallback)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	bs, err := json.Marshal(m.bounds)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, partitionsFile), bs, 0644)
+}
+
+// LoadFromDisk restores every partition from the backups created by
+// StoreToDisk(). The backup should have been taken using the same partition
+// boundaries. Otherwise, ErrPartitionMismatch is returned.
+func (m *PartitionedNitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*PartitionedSnapshot, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, partitionsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrPartitionMismatch
+		}
+		return nil, err
+	}
+
+	var bounds [][]byte
+	if err := json.Unmarshal(data, &bounds); err != nil {
+		return nil, err
+	}
+
+	if len(bounds) != len(m.bounds) {
+		return nil, ErrPartitionMismatch
+	}
+
+	for i := range bounds {
+		if !bytes.Equal(bounds[i], m.bounds[i]) {
+			return nil, ErrPartitionMismatch
+		}
+	}
+
+	snap := &PartitionedSnapshot{m: m}
+	for i, p := range m.parts {
+		s, err := p.LoadFromDisk(filepath.Join(dir, partitionName(i)), concurr, callb)
+		if err != nil {
+			snap.Close()
+			return nil, err
+		}
+		snap.snaps = append(snap.snaps, s)
+	}
+
+	return snap, nil
+}
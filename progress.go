@@ -0,0 +1,209 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// ProgressPhase describes the phase of a backup or restore
+type ProgressPhase int
+
+const (
+	// ProgressIdle means no backup or restore has been started
+	ProgressIdle ProgressPhase = iota
+	// ProgressData means the data shards are being stored or restored
+	ProgressData
+	// ProgressDelta means the delta shards are being restored
+	ProgressDelta
+	// ProgressIncremental means the incremental backups are being restored
+	ProgressIncremental
+	// ProgressWAL means the write-ahead log is being replayed
+	ProgressWAL
+	// ProgressDone means the backup or restore has completed successfully
+	ProgressDone
+)
+
+// ShardProgress describes the items processed for a shard of a backup
+// Bytes is the size of the item data. The totals are zero if not known.
+type ShardProgress struct {
+	Items      int64
+	Bytes      int64
+	TotalItems int64
+	TotalBytes int64
+}
+
+// BackupProgress describes the progress of a backup or restore
+// The data shard totals are recorded in the backup manifest. Hence, they are
+// known only for the restore of a backup created by this version.
+// The aggregate totals of a backup are based on the snapshot item count.
+type BackupProgress struct {
+	Restore bool
+	Phase   ProgressPhase
+	Shards  []ShardProgress
+	Delta   []ShardProgress
+
+	Items      int64
+	Bytes      int64
+	TotalItems int64
+	TotalBytes int64
+}
+
+type shardCounter struct {
+	items, bytes           int64
+	totalItems, totalBytes int64
+}
+
+func (c *shardCounter) add(itm *Item) {
+	atomic.AddInt64(&c.items, 1)
+	atomic.AddInt64(&c.bytes, int64(itm.dataSize()))
+}
+
+func (c *shardCounter) progress() ShardProgress {
+	return ShardProgress{
+		Items:      atomic.LoadInt64(&c.items),
+		Bytes:      atomic.LoadInt64(&c.bytes),
+		TotalItems: c.totalItems,
+		TotalBytes: c.totalBytes,
+	}
+}
+
+type progressTracker struct {
+	sync.Mutex
+	restore    bool
+	phase      ProgressPhase
+	totalItems int64
+	shards     []*shardCounter
+	delta      []*shardCounter
+}
+
+func newShardCounters(n int, totals []backupShard) []*shardCounter {
+	counters := make([]*shardCounter, n)
+	for i := range counters {
+		counters[i] = &shardCounter{}
+		if i < len(totals) {
+			counters[i].totalItems = totals[i].Items
+			counters[i].totalBytes = totals[i].Bytes
+		}
+	}
+
+	return counters
+}
+
+// setShards starts tracking the data or delta shards of a backup
+func (p *progressTracker) setShards(delta bool, n int, totals []backupShard) []*shardCounter {
+	p.Lock()
+	defer p.Unlock()
+
+	counters := newShardCounters(n, totals)
+	if delta {
+		p.delta = counters
+	} else {
+		p.shards = counters
+	}
+
+	return counters
+}
+
+func (p *progressTracker) setPhase(phase ProgressPhase) {
+	p.Lock()
+	defer p.Unlock()
+	p.phase = phase
+}
+
+// backupShards returns the shard sizes to be recorded in the manifest
+func (p *progressTracker) backupShards(delta bool) []backupShard {
+	p.Lock()
+	defer p.Unlock()
+
+	counters := p.shards
+	if delta {
+		counters = p.delta
+	}
+
+	var shards []backupShard
+	for _, c := range counters {
+		sp := c.progress()
+		shards = append(shards, backupShard{Items: sp.Items, Bytes: sp.Bytes})
+	}
+
+	return shards
+}
+
+func (p *progressTracker) progress() BackupProgress {
+	p.Lock()
+	defer p.Unlock()
+
+	bp := BackupProgress{Restore: p.restore, Phase: p.phase, TotalItems: p.totalItems}
+	for _, c := range p.shards {
+		sp := c.progress()
+		bp.Shards = append(bp.Shards, sp)
+		bp.Items += sp.Items
+		bp.Bytes += sp.Bytes
+		bp.TotalItems += sp.TotalItems
+		bp.TotalBytes += sp.TotalBytes
+	}
+
+	for _, c := range p.delta {
+		bp.Delta = append(bp.Delta, c.progress())
+	}
+
+	return bp
+}
+
+// progressWriter counts the items written to a backup shard
+type progressWriter struct {
+	FileWriter
+	c *shardCounter
+}
+
+func (w *progressWriter) WriteItem(itm *Item) error {
+	if err := w.FileWriter.WriteItem(itm); err != nil {
+		return err
+	}
+
+	w.c.add(itm)
+	return nil
+}
+
+// progressReader counts the items read from a backup shard
+type progressReader struct {
+	FileReader
+	c *shardCounter
+}
+
+func (r *progressReader) ReadItem() (*Item, error) {
+	itm, err := r.FileReader.ReadItem()
+	if itm != nil {
+		r.c.add(itm)
+	}
+
+	return itm, err
+}
+
+func (m *Nitro) startProgress(restore bool, totalItems int64) *progressTracker {
+	p := &progressTracker{restore: restore, phase: ProgressData, totalItems: totalItems}
+	atomic.StorePointer(&m.progress, unsafe.Pointer(p))
+	return p
+}
+
+// GetBackupProgress returns the progress of the backup or restore in progress
+// or the last one started. It can be polled to estimate the time remaining and
+// to detect a stalled backup or restore.
+func (m *Nitro) GetBackupProgress() BackupProgress {
+	p := (*progressTracker)(atomic.LoadPointer(&m.progress))
+	if p == nil {
+		return BackupProgress{}
+	}
+
+	return p.progress()
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrMemoryQuotaExceeded means the Nitro instance memory usage is above the quota
+var ErrMemoryQuotaExceeded = fmt.Errorf("Memory quota exceeded")
+
+const (
+	memQuotaCheckInterval = 256
+	memQuotaPollInterval  = time.Millisecond
+)
+
+func (w *Writer) checkMemQuota() error {
+	if w.memQuota == 0 {
+		return nil
+	}
+
+	if atomic.LoadInt32(&w.quotaExceeded) == 0 {
+		if w.quotaChecks++; w.quotaChecks%memQuotaCheckInterval != 0 {
+			return nil
+		}
+
+		if w.MemoryInUse() < w.memQuota {
+			return nil
+		}
+		atomic.StoreInt32(&w.quotaExceeded, 1)
+	}
+
+	deadline := time.Now().Add(w.memQuotaTimeout)
+	for {
+		if w.MemoryInUse() < w.memQuotaLow {
+			atomic.StoreInt32(&w.quotaExceeded, 0)
+			return nil
+		}
+
+		if !time.Now().Before(deadline) || w.hasShutdown {
+			return ErrMemoryQuotaExceeded
+		}
+		time.Sleep(memQuotaPollInterval)
+	}
+}
@@ -75,9 +75,27 @@ func (it *Iterator) Seek(itm unsafe.Pointer) bool {
 	return found
 }
 
+// SeekLast moves cursor to the last item
+func (it *Iterator) SeekLast() {
+	it.valid = true
+	it.prev, it.curr = it.s.findLast()
+	it.skipDeletedBackward()
+}
+
+// SeekForPrev moves iterator to a provided item or the previous smaller item
+// if the item does not exist
+func (it *Iterator) SeekForPrev(itm unsafe.Pointer) bool {
+	found := it.Seek(itm)
+	if !found {
+		it.Prev()
+	}
+
+	return found
+}
+
 // Valid returns true when iterator reaches the end
 func (it *Iterator) Valid() bool {
-	if it.valid && it.curr == it.s.tail {
+	if it.valid && (it.curr == it.s.tail || it.curr == it.s.head) {
 		it.valid = false
 	}
 
@@ -131,6 +149,27 @@ retry:
 	}
 }
 
+// Prev moves iterator to the previous item
+// Since the skiplist nodes only have forward links, the predecessor is located
+// by performing a lookup for the current item.
+func (it *Iterator) Prev() {
+	it.valid = true
+	it.prev, it.curr = it.s.findPrev(it.curr, it.cmp, it.buf)
+	it.skipDeletedBackward()
+}
+
+func (it *Iterator) skipDeletedBackward() {
+	for it.curr != it.s.head {
+		if _, deleted := it.curr.getNext(0); !deleted {
+			return
+		}
+		it.prev, it.curr = it.s.findPrev(it.curr, it.cmp, it.buf)
+	}
+
+	// Reached the beginning
+	it.valid = false
+}
+
 // Close is a destructor
 func (it *Iterator) Close() {
 	if it.bs != nil {
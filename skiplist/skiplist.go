@@ -247,6 +247,92 @@ retry:
 	return
 }
 
+// Find returns the first node which compares equal to itm and whose item is
+// accepted by the filter function.
+// It is a read-only lookup which does not require an action buffer.
+// Explicit barrier and release should be used by the caller before
+// and after this function call
+func (s *Skiplist) Find(itm unsafe.Pointer, cmp CompareFn,
+	filter func(unsafe.Pointer) bool) *Node {
+
+	prev := s.head
+	curr := prev
+	level := int(atomic.LoadInt32(&s.level))
+	for i := level; i >= 0; i-- {
+		curr, _ = prev.getNext(i)
+		for compare(cmp, curr.Item(), itm) < 0 {
+			prev = curr
+			curr, _ = curr.getNext(i)
+		}
+	}
+
+	for ; compare(cmp, curr.Item(), itm) == 0; curr, _ = curr.getNext(0) {
+		if filter == nil || filter(curr.Item()) {
+			return curr
+		}
+	}
+
+	return nil
+}
+
+// findPrev returns the node which precedes the given node at level 0 along
+// with its own predecessor
+func (s *Skiplist) findPrev(n *Node, cmp CompareFn, buf *ActionBuffer) (prev, curr *Node) {
+	if n == s.tail {
+		return s.findLast()
+	}
+
+	if n == s.head {
+		return s.head, s.head
+	}
+
+	s.findPath(n.Item(), cmp, buf, &s.Stats)
+	prev = s.head
+	curr = buf.preds[0]
+
+	// The predecessor of the node found is located by a lookup for its item
+	// which positions the path before the items comparing equal to it
+	if curr != s.head {
+		s.findPath(curr.Item(), cmp, buf, &s.Stats)
+		prev = buf.preds[0]
+		curr, _ = prev.getNext(0)
+	}
+
+	// Items which compare equal to the node may be placed before it
+	for {
+		next, _ := curr.getNext(0)
+		if next == n || next == s.tail || compare(cmp, next.Item(), n.Item()) > 0 {
+			break
+		}
+		prev = curr
+		curr = next
+	}
+
+	return
+}
+
+// findLast returns the last node in the skiplist along with its predecessor
+func (s *Skiplist) findLast() (prev, curr *Node) {
+	prev = s.head
+	curr = s.head
+	level := int(atomic.LoadInt32(&s.level))
+	for i := level; i >= 0; i-- {
+		for {
+			next, _ := curr.getNext(i)
+			if next == s.tail {
+				break
+			}
+
+			if i == 0 {
+				prev = curr
+			}
+			curr = next
+		}
+	}
+
+	return
+}
+
 // Insert adds an item into the skiplist
 func (s *Skiplist) Insert(itm unsafe.Pointer, cmp CompareFn,
 	buf *ActionBuffer, sts *Stats) (success bool) {
@@ -393,6 +479,49 @@ func (s *Skiplist) deleteNode(n *Node, cmp CompareFn, buf *ActionBuffer, sts *St
 	return false
 }
 
+// SampleRange returns the items in the range [lo, hi) from the highest level
+// which has at least minSamples nodes in the range, along with the average
+// number of items represented by each of them. A nil lo or hi leaves the range
+// unbounded. If none of the levels has enough nodes, all the items in the
+// range are returned from level 0.
+// Explicit barrier and release should be used by the caller before
+// and after this function call
+func (s *Skiplist) SampleRange(lo, hi unsafe.Pointer, cmp CompareFn, minSamples int,
+	buf *ActionBuffer, sts *Stats) (samples []unsafe.Pointer, weight int64) {
+	level := int(atomic.LoadInt32(&s.level))
+	if lo != nil {
+		s.findPath(lo, cmp, buf, sts)
+	} else {
+		for l := 0; l <= level; l++ {
+			buf.preds[l] = s.head
+		}
+	}
+
+	// A node is promoted to the next level with probability p
+	weight = 1
+	for l := 0; l < level; l++ {
+		weight = int64(float64(weight) / p)
+	}
+
+	for l := level; l >= 0; l-- {
+		samples = samples[:0]
+		node, _ := buf.preds[l].getNext(l)
+		for ; node != s.tail; node, _ = node.getNext(l) {
+			if hi != nil && compare(cmp, node.Item(), hi) >= 0 {
+				break
+			}
+			samples = append(samples, node.Item())
+		}
+
+		if len(samples) >= minSamples || l == 0 {
+			break
+		}
+		weight = int64(float64(weight) * p)
+	}
+
+	return
+}
+
 // GetRangeSplitItems returns `nways` split range pivots of the skiplist items
 // Explicit barrier and release should be used by the caller before
 // and after this function call
@@ -148,6 +148,36 @@ func TestGetPerf(t *testing.T) {
 
 }
 
+func TestSampleRange(t *testing.T) {
+	var wg sync.WaitGroup
+	sl := New()
+	n := 100000
+	wg.Add(1)
+	go doInsert(sl, &wg, n, false)
+	wg.Wait()
+
+	buf := sl.MakeBuf()
+	defer sl.FreeBuf(buf)
+
+	samples, weight := sl.SampleRange(nil, nil, CompareInt, 100, buf, &sl.Stats)
+	if est := int64(len(samples)) * weight; est < int64(n)/2 || est > int64(n)*2 {
+		t.Errorf("Expected an estimate close to %d. got %d", n, est)
+	}
+
+	for i := 1; i < len(samples); i++ {
+		if CompareInt(samples[i-1], samples[i]) >= 0 {
+			t.Errorf("Expected samples in order")
+		}
+	}
+
+	// A small range is counted exactly from level 0
+	lo, hi := NewIntKeyItem(500), NewIntKeyItem(550)
+	samples, weight = sl.SampleRange(lo, hi, CompareInt, 100, buf, &sl.Stats)
+	if weight != 1 || len(samples) != 50 || IntFromItem(samples[0]) != 500 {
+		t.Errorf("Expected 50 items from 500. got %d items of weight %d", len(samples), weight)
+	}
+}
+
 func TestGetRangeSplitItems(t *testing.T) {
 	var wg sync.WaitGroup
 	sl := New()
@@ -223,3 +253,54 @@ func TestBuilder(t *testing.T) {
 	}
 
 }
+
+func TestReverseIterator(t *testing.T) {
+	s := New()
+	cmp := CompareBytes
+	buf := s.MakeBuf()
+	defer s.FreeBuf(buf)
+
+	for i := 0; i < 2000; i += 2 {
+		s.Insert(NewByteKeyItem([]byte(fmt.Sprintf("%010d", i))), cmp, buf, &s.Stats)
+	}
+
+	for i := 1000; i < 1500; i += 2 {
+		s.Delete(NewByteKeyItem([]byte(fmt.Sprintf("%010d", i))), cmp, buf, &s.Stats)
+	}
+
+	itr := s.NewIterator(cmp, buf)
+	defer itr.Close()
+
+	expected := 1998
+	for itr.SeekLast(); itr.Valid(); itr.Prev() {
+		if expected == 1498 {
+			expected = 998
+		}
+		got := string(*(*byteKeyItem)(itr.Get()))
+		if got != fmt.Sprintf("%010d", expected) {
+			t.Errorf("Expected %010d, got %v", expected, got)
+		}
+		expected -= 2
+	}
+
+	if expected != -2 {
+		t.Errorf("Expected to reach the beginning, stopped at %d", expected)
+	}
+
+	itr.SeekForPrev(NewByteKeyItem([]byte(fmt.Sprintf("%010d", 1201))))
+	if got := string(*(*byteKeyItem)(itr.Get())); !itr.Valid() || got != fmt.Sprintf("%010d", 998) {
+		t.Errorf("Expected SeekForPrev to find 998, got %v", got)
+	}
+
+	itr.Next()
+	if got := string(*(*byteKeyItem)(itr.Get())); !itr.Valid() || got != fmt.Sprintf("%010d", 1500) {
+		t.Errorf("Expected Next to find 1500, got %v", got)
+	}
+
+	// Prev positions the iterator on the real predecessor of the current node
+	for itr.SeekLast(); itr.Valid(); itr.Prev() {
+		if next, _ := itr.prev.getNext(0); next != itr.curr {
+			t.Errorf("Expected the predecessor of %v", string(*(*byteKeyItem)(itr.Get())))
+		}
+	}
+}
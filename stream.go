@@ -0,0 +1,394 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/couchbase/nitro/skiplist"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Backup stream format:
+// [8 byte magic][frame]...
+// frame: [1 byte type][4 byte shard][4 byte len][4 byte crc32c][data]
+// The checksum covers the type, shard and length fields along with the data.
+// The first frame holds the backup manifest and the last frame marks the end
+// of the stream. Data and delta frames hold a block of encoded items of a
+// shard. Frames of different shards are interleaved as they are written
+// concurrently and the frames of a shard are in the order of its items.
+const (
+	streamMagic           = "NITROBAK"
+	streamFrameHeaderSize = 13
+	maxStreamShards       = 1 << 16
+)
+
+const (
+	frameManifest byte = iota + 1
+	frameData
+	frameDelta
+	frameEnd
+)
+
+var (
+	// ErrInvalidStream means the backup stream is malformed or corrupt
+	ErrInvalidStream = fmt.Errorf("Invalid backup stream")
+	// ErrInvalidConcurrency means the number of threads is not positive
+	ErrInvalidConcurrency = fmt.Errorf("Concurrency should be positive")
+)
+
+type streamWriter struct {
+	sync.Mutex
+	w   *bufio.Writer
+	hdr []byte
+	err error
+}
+
+func (s *streamWriter) writeFrame(typ byte, shard int, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	s.hdr[0] = typ
+	binary.BigEndian.PutUint32(s.hdr[1:5], uint32(shard))
+	binary.BigEndian.PutUint32(s.hdr[5:9], uint32(len(data)))
+	binary.BigEndian.PutUint32(s.hdr[9:13], frameChecksum(s.hdr, data))
+	if _, s.err = s.w.Write(s.hdr); s.err == nil {
+		_, s.err = s.w.Write(data)
+	}
+
+	return s.err
+}
+
+func frameChecksum(hdr []byte, data []byte) uint32 {
+	crc := crc32.Checksum(hdr[0:9], crc32cTable)
+	return crc32.Update(crc, crc32cTable, data)
+}
+
+// streamFileWriter writes the items of a shard as frames of the stream
+type streamFileWriter struct {
+	db    *Nitro
+	s     *streamWriter
+	typ   byte
+	shard int
+	buf   []byte
+	block bytes.Buffer
+}
+
+func (f *streamFileWriter) Open(path string) error {
+	f.buf = make([]byte, encodeBufSize)
+	return nil
+}
+
+func (f *streamFileWriter) WriteItem(itm *Item) error {
+	if err := f.db.EncodeItem(itm, f.buf, &f.block); err != nil {
+		return err
+	}
+
+	if f.block.Len() >= DiskBlockSize {
+		return f.flush()
+	}
+
+	return nil
+}
+
+func (f *streamFileWriter) flush() error {
+	if f.block.Len() == 0 {
+		return nil
+	}
+
+	err := f.s.writeFrame(f.typ, f.shard, f.block.Bytes())
+	f.block.Reset()
+	return err
+}
+
+func (f *streamFileWriter) Close() error {
+	return f.flush()
+}
+
+type streamBackup struct {
+	db *Nitro
+	s  *streamWriter
+}
+
+func (b *streamBackup) newFileWriter(kind backupFiles, shard int) (FileWriter, error) {
+	w := &streamFileWriter{db: b.db, s: b.s, typ: frameData, shard: shard}
+	switch kind {
+	case deltaFiles:
+		w.typ = frameDelta
+	case deletedFiles:
+		return nil, fmt.Errorf("Incremental backup streams are not supported")
+	}
+
+	return w, w.Open("")
+}
+
+// writeManifest is a no-op as the manifest is the first frame of the stream
+func (b *streamBackup) writeManifest(manifest backupManifest) error {
+	return nil
+}
+
+func (b *streamBackup) commit(kind backupFiles) error {
+	return nil
+}
+
+// StoreToStream backups Nitro snapshot into a single stream
+// It is similar to StoreToDisk(), but the data and delta shards are
+// multiplexed into the stream. The stream can be restored using
+// LoadFromStream().
+func (m *Nitro) StoreToStream(w io.Writer, snap *Snapshot, concurr int, itmCallback ItemCallback) error {
+	if concurr <= 0 {
+		snap.Close()
+		return ErrInvalidConcurrency
+	}
+
+	s := &streamWriter{
+		w:   bufio.NewWriterSize(w, DiskBlockSize),
+		hdr: make([]byte, streamFrameHeaderSize),
+	}
+
+	if _, err := s.w.WriteString(streamMagic); err != nil {
+		snap.Close()
+		return err
+	}
+
+	bs, _ := json.Marshal(m.newBackupManifest(snap.sn))
+	if err := s.writeFrame(frameManifest, 0, bs); err != nil {
+		snap.Close()
+		return err
+	}
+
+	b := &streamBackup{db: m, s: s}
+	if err := m.storeSnapshot(context.Background(), b, nil, snap, concurr, itmCallback); err != nil {
+		return err
+	}
+
+	// All the shard writers have been closed and flushed their frames
+	if err := s.writeFrame(frameEnd, 0, nil); err != nil {
+		return err
+	}
+
+	return s.w.Flush()
+}
+
+type streamFrame struct {
+	typ   byte
+	shard int
+	data  []byte
+}
+
+func readStreamFrame(r io.Reader, hdr []byte) (*streamFrame, error) {
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrInvalidStream
+		}
+		return nil, err
+	}
+
+	f := &streamFrame{
+		typ:   hdr[0],
+		shard: int(binary.BigEndian.Uint32(hdr[1:5])),
+	}
+
+	// The data is read incrementally so that a corrupt length does not
+	// allocate a huge buffer before the checksum is verified
+	var data bytes.Buffer
+	l := int64(binary.BigEndian.Uint32(hdr[5:9]))
+	if n, err := io.CopyN(&data, r, l); n != l {
+		if err == io.EOF {
+			err = ErrInvalidStream
+		}
+		return nil, err
+	}
+
+	f.data = data.Bytes()
+	if frameChecksum(hdr, f.data) != binary.BigEndian.Uint32(hdr[9:13]) {
+		return nil, ErrInvalidStream
+	}
+
+	if f.typ < frameManifest || f.typ > frameEnd || f.shard >= maxStreamShards {
+		return nil, ErrInvalidStream
+	}
+
+	return f, nil
+}
+
+// decodeItems decodes the encoded items of a data or delta frame
+func (m *Nitro) decodeItems(data []byte, version int, fn func(*Item)) error {
+	buf := make([]byte, encodeBufSize)
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		itm, err := m.DecodeItem(version, buf, r)
+		if err != nil || itm == nil {
+			if itm != nil {
+				m.freeItem(itm)
+			}
+			return ErrInvalidStream
+		}
+
+		fn(itm)
+	}
+
+	return nil
+}
+
+// LoadFromStream restores Nitro from a backup stream created by StoreToStream()
+// The data shards are restored concurrently as their frames are read.
+func (m *Nitro) LoadFromStream(r io.Reader, concurr int, callb ItemCallback) (*Snapshot, error) {
+	if concurr <= 0 {
+		return nil, ErrInvalidConcurrency
+	}
+
+	var wg sync.WaitGroup
+	br := bufio.NewReaderSize(r, DiskBlockSize)
+	hdr := make([]byte, streamFrameHeaderSize)
+
+	magic := make([]byte, len(streamMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != streamMagic {
+		return nil, ErrInvalidStream
+	}
+
+	f, err := readStreamFrame(br, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest backupManifest
+	if f.typ != frameManifest || json.Unmarshal(f.data, &manifest) != nil {
+		return nil, ErrInvalidStream
+	}
+
+	var nodeCallb skiplist.NodeCallback
+	if callb != nil {
+		nodeCallb = func(n *skiplist.Node) {
+			callb(&ItemEntry{itm: (*Item)(n.Item()), n: n})
+		}
+	}
+
+	type segmentBlock struct {
+		segment *skiplist.Segment
+		data    []byte
+	}
+
+	// Blocks of a shard are always processed by the same worker to retain
+	// the order of the items in the segment
+	b := skiplist.NewBuilderWithConfig(m.newStoreConfig())
+	b.SetItemSizeFunc(ItemSize)
+	var segments []*skiplist.Segment
+	wchans := make([]chan segmentBlock, concurr)
+	errors := make([]error, concurr)
+	for i := 0; i < concurr; i++ {
+		wchans[i] = make(chan segmentBlock, 1)
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for blk := range wchans[id] {
+				if errors[id] != nil {
+					continue
+				}
+
+				errors[id] = m.decodeItems(blk.data, manifest.Version, func(itm *Item) {
+					if itm.expiry() != 0 {
+						atomic.AddInt64(&m.ttlItems, 1)
+					}
+					blk.segment.Add(unsafe.Pointer(itm))
+				})
+			}
+		}(i)
+	}
+
+	var deltaItems []*Item
+loop:
+	for {
+		if f, err = readStreamFrame(br, hdr); err != nil {
+			break
+		}
+
+		switch f.typ {
+		case frameData:
+			for len(segments) <= f.shard {
+				segment := b.NewSegment()
+				segment.SetNodeCallback(nodeCallb)
+				segments = append(segments, segment)
+			}
+			wchans[f.shard%concurr] <- segmentBlock{segment: segments[f.shard], data: f.data}
+		case frameDelta:
+			err = m.decodeItems(f.data, manifest.Version, func(itm *Item) {
+				deltaItems = append(deltaItems, itm)
+			})
+		case frameEnd:
+			break loop
+		default:
+			err = ErrInvalidStream
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	for _, ch := range wchans {
+		close(ch)
+	}
+	wg.Wait()
+
+	for _, e := range errors {
+		if err == nil {
+			err = e
+		}
+	}
+
+	if err != nil {
+		for _, itm := range deltaItems {
+			m.freeItem(itm)
+		}
+		return nil, err
+	}
+
+	m.store = b.Assemble(segments...)
+
+	// Delta items are restored once all the data shards have been loaded
+	if len(deltaItems) > 0 {
+		m.DeltaRestoreFailed = 0
+		m.DeltaRestored = 0
+
+		w := m.newWriter()
+		for _, itm := range deltaItems {
+			if n, success := w.store.Insert2(unsafe.Pointer(itm),
+				w.insCmp, w.existCmp, w.buf, w.rand.Float32, &w.slSts1); success {
+
+				m.DeltaRestored++
+				if nodeCallb != nil {
+					nodeCallb(n)
+				}
+			} else {
+				w.freeItem(itm)
+				m.DeltaRestoreFailed++
+			}
+		}
+		m.store.Stats.Merge(&w.slSts1)
+	}
+
+	m.buildIndexes()
+	stats := m.store.GetStats()
+	m.itemsCount = int64(stats.NodeCount)
+	return m.NewSnapshot()
+}
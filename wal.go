@@ -0,0 +1,650 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/couchbase/nitro/nodetable"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// WALSyncPolicy describes when the write-ahead log is synced to disk
+type WALSyncPolicy int
+
+const (
+	// WALSyncNone writes every record to the log file and leaves syncing to
+	// the operating system. Mutations survive a process crash, but not a
+	// system crash.
+	WALSyncNone WALSyncPolicy = iota
+	// WALSyncInterval buffers the records and syncs the log periodically
+	WALSyncInterval
+	// WALSyncAlways syncs the log before a mutation returns. Writers waiting
+	// concurrently share a single sync (group commit).
+	WALSyncAlways
+)
+
+const (
+	walOpPut byte = iota + 1
+	walOpDelete
+	walOpReplace
+	walOpBatch
+)
+
+const (
+	walRecordHeaderSize    = 13
+	walKeyStripes          = 64
+	defaultWALSyncInterval = 100 * time.Millisecond
+)
+
+// ErrCorruptWAL means a write-ahead log segment other than the last one is corrupt
+var ErrCorruptWAL = fmt.Errorf("Write-ahead log is corrupt")
+
+// walSegment is a closed log file
+// maxSn is the maximum snapshot number of the mutations in the segment.
+type walSegment struct {
+	path  string
+	maxSn uint32
+}
+
+// wal is the write-ahead log of the Nitro writers
+// Record format: [4 byte len][4 byte crc32c][1 byte op][4 byte expiry][data]
+// The data of a batch record is a sequence of [1 byte op][4 byte len][data]
+// entries so that a batch is either replayed fully or not at all.
+// The log is a sequence of segment files. A new segment is started once a
+// backup completes and the segments containing only the mutations which are
+// part of the backup are removed.
+// The log lock only protects the appends. A mutation is applied and appended
+// while holding the lock of its key stripe, so that the records of a key are
+// in the order in which its mutations took effect.
+type wal struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	keyHash  nodetable.HashFn
+	keyLocks [walKeyStripes]sync.Mutex
+
+	dir      string
+	policy   WALSyncPolicy
+	interval time.Duration
+
+	fd       *os.File
+	w        *bufio.Writer
+	hdr      []byte
+	seq      int
+	maxSn    uint32
+	segments []walSegment
+	replay   []string // Segments created before the log was opened
+
+	appended uint64
+	synced   uint64
+	syncing  bool
+	err      error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func walSegmentName(seq int) string {
+	return fmt.Sprintf("wal-%010d.log", seq)
+}
+
+// openWAL opens the log for appending into a new segment
+// A failure is recorded and returned by all the subsequent appends. The keys
+// are mapped to their locks using the hash. All the mutations share a lock if
+// the hash is nil.
+func openWAL(dir string, policy WALSyncPolicy, interval time.Duration, keyHash nodetable.HashFn) *wal {
+	if interval <= 0 {
+		interval = defaultWALSyncInterval
+	}
+
+	l := &wal{
+		dir:      dir,
+		policy:   policy,
+		interval: interval,
+		keyHash:  keyHash,
+		hdr:      make([]byte, walRecordHeaderSize),
+	}
+	l.cond = sync.NewCond(l)
+
+	if l.err = os.MkdirAll(dir, 0755); l.err != nil {
+		return l
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if l.err = err; err != nil {
+		return l
+	}
+
+	sort.Strings(files)
+	for _, file := range files {
+		var seq int
+		fmt.Sscanf(filepath.Base(file), "wal-%d.log", &seq)
+		if seq > l.seq {
+			l.seq = seq
+		}
+	}
+
+	// The segments of the previous instances become obsolete only once
+	// LoadFromDisk has replayed them
+	l.replay = files
+
+	if l.err = l.openSegment(); l.err == nil && policy == WALSyncInterval {
+		l.stop = make(chan struct{})
+		l.done = make(chan struct{})
+		go l.syncWorker()
+	}
+
+	return l
+}
+
+func (l *wal) openSegment() (err error) {
+	l.seq++
+	l.maxSn = 0
+	path := filepath.Join(l.dir, walSegmentName(l.seq))
+	if l.fd, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err == nil {
+		l.w = bufio.NewWriterSize(l.fd, DiskBlockSize)
+	}
+
+	return
+}
+
+// add appends a record and returns its log sequence number
+func (l *wal) add(op byte, sn uint32, expiry uint32, bs []byte) (uint64, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.err != nil {
+		return 0, l.err
+	}
+
+	binary.BigEndian.PutUint32(l.hdr[0:4], uint32(len(bs)+5))
+	l.hdr[8] = op
+	binary.BigEndian.PutUint32(l.hdr[9:13], expiry)
+	crc := crc32.Checksum(l.hdr[8:13], crc32cTable)
+	binary.BigEndian.PutUint32(l.hdr[4:8], crc32.Update(crc, crc32cTable, bs))
+
+	if _, l.err = l.w.Write(l.hdr); l.err == nil {
+		_, l.err = l.w.Write(bs)
+	}
+
+	if l.err == nil && l.policy == WALSyncNone {
+		l.err = l.w.Flush()
+	}
+
+	if sn > l.maxSn {
+		l.maxSn = sn
+	}
+
+	l.appended++
+	return l.appended, l.err
+}
+
+func (l *wal) error() error {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.err
+}
+
+// stripe returns the key lock of the key
+func (l *wal) stripe(bs []byte) int {
+	if l.keyHash == nil {
+		return 0
+	}
+
+	return int(l.keyHash(bs) % walKeyStripes)
+}
+
+// lockKeys locks the key stripes in the ascending order and returns the
+// locked stripes
+func (l *wal) lockKeys(stripes []int) []int {
+	sort.Ints(stripes)
+	locked := stripes[:0]
+	for i, stripe := range stripes {
+		if i == 0 || stripe != stripes[i-1] {
+			locked = append(locked, stripe)
+			l.keyLocks[stripe].Lock()
+		}
+	}
+
+	return locked
+}
+
+func (l *wal) unlockKeys(stripes []int) {
+	for _, stripe := range stripes {
+		l.keyLocks[stripe].Unlock()
+	}
+}
+
+// waitSync waits until the record lsn has been synced when the sync policy
+// is WALSyncAlways. The writer which finds no sync in progress syncs the log
+// on behalf of all the waiting writers.
+func (l *wal) waitSync(lsn uint64) error {
+	if l.policy != WALSyncAlways {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	for l.synced < lsn && l.err == nil {
+		if l.syncing {
+			l.cond.Wait()
+			continue
+		}
+
+		l.syncLocked()
+	}
+
+	return l.err
+}
+
+// syncLocked flushes the buffered records and syncs the log file
+// The lock is released while the file is synced to let writers append.
+func (l *wal) syncLocked() {
+	if l.err = l.w.Flush(); l.err != nil {
+		return
+	}
+
+	l.syncing = true
+	target := l.appended
+	fd := l.fd
+	l.Unlock()
+	err := fd.Sync()
+	l.Lock()
+	l.syncing = false
+
+	if err != nil {
+		l.err = err
+	} else if target > l.synced {
+		l.synced = target
+	}
+	l.cond.Broadcast()
+}
+
+func (l *wal) syncWorker() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.Lock()
+			if l.err == nil && !l.syncing && l.synced < l.appended {
+				l.syncLocked()
+			}
+			l.Unlock()
+		}
+	}
+}
+
+// closeSegment syncs and closes the active segment
+func (l *wal) closeSegment() error {
+	for l.syncing {
+		l.cond.Wait()
+	}
+
+	if l.err == nil {
+		if l.err = l.w.Flush(); l.err == nil {
+			l.err = l.fd.Sync()
+		}
+	}
+
+	l.synced = l.appended
+	l.cond.Broadcast()
+	if err := l.fd.Close(); l.err == nil {
+		l.err = err
+	}
+
+	return l.err
+}
+
+// truncate starts a new segment and removes the segments whose mutations
+// are older than the backup of snapshot sn
+func (l *wal) truncate(sn uint32) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.err != nil {
+		return l.err
+	}
+
+	path := l.fd.Name()
+	if l.closeSegment() != nil {
+		return l.err
+	}
+	l.segments = append(l.segments, walSegment{path: path, maxSn: l.maxSn})
+
+	if l.err = l.openSegment(); l.err != nil {
+		return l.err
+	}
+
+	// Mutations with the snapshot number of the backup may have been
+	// performed after the backup iterator has passed the item
+	var segments []walSegment
+	for _, seg := range l.segments {
+		if seg.maxSn < sn {
+			if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		} else {
+			segments = append(segments, seg)
+		}
+	}
+	l.segments = segments
+
+	return nil
+}
+
+// replayed marks the segments of the previous instances as obsolete once
+// the next backup completes
+func (l *wal) replayed() {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, path := range l.replay {
+		l.segments = append(l.segments, walSegment{path: path})
+	}
+	l.replay = nil
+}
+
+func (l *wal) close() error {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.fd == nil {
+		return l.err
+	}
+
+	return l.closeSegment()
+}
+
+// readWALSegment reads the records of a segment
+// It returns io.ErrUnexpectedEOF if the segment ends with a partial or
+// corrupt record.
+func readWALSegment(path string, fn func(op byte, expiry uint32, bs []byte)) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	r := bufio.NewReaderSize(fd, DiskBlockSize)
+	hdr := make([]byte, walRecordHeaderSize)
+	var data []byte
+	for {
+		if _, err := io.ReadFull(r, hdr[0:8]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+
+		l := int(binary.BigEndian.Uint32(hdr[0:4]))
+		if l < 5 {
+			return io.ErrUnexpectedEOF
+		}
+
+		if cap(data) < l {
+			data = make([]byte, l)
+		}
+		data = data[:l]
+
+		if _, err := io.ReadFull(r, data); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+
+		if crc32.Checksum(data, crc32cTable) != binary.BigEndian.Uint32(hdr[4:8]) {
+			return io.ErrUnexpectedEOF
+		}
+
+		fn(data[0], binary.BigEndian.Uint32(data[1:5]), data[5:])
+	}
+}
+
+// logMutation performs a mutation of the writer using the apply function and
+// appends it to the log if it succeeds. If the log has failed, the mutation is
+// not performed. Returns whether the mutation was performed along with the
+// log sequence number of its record.
+func (w *Writer) logMutation(op byte, sn uint32, expiry uint32, bs []byte,
+	apply func() bool) (bool, uint64, error) {
+	if w.wal == nil {
+		return apply(), 0, nil
+	}
+
+	w.walStripes = append(w.walStripes[:0], w.wal.stripe(bs))
+	return w.logKeys(op, sn, expiry, bs, apply)
+}
+
+// logBatch is same as logMutation() for the mutations of a write batch which
+// are logged as a single record
+func (w *Writer) logBatch(sn uint32, ops []batchOp, apply func() bool) (bool, uint64, error) {
+	if w.wal == nil {
+		return apply(), 0, nil
+	}
+
+	w.walStripes = w.walStripes[:0]
+	for _, op := range ops {
+		w.walStripes = append(w.walStripes, w.wal.stripe(op.bs))
+	}
+
+	return w.logKeys(walOpBatch, sn, 0, encodeWALBatch(ops), apply)
+}
+
+// logKeys applies and logs a mutation while holding the locks of the key
+// stripes in w.walStripes. The mutations of the other keys are applied and
+// logged concurrently.
+func (w *Writer) logKeys(op byte, sn uint32, expiry uint32, bs []byte,
+	apply func() bool) (bool, uint64, error) {
+	stripes := w.wal.lockKeys(w.walStripes)
+	defer w.wal.unlockKeys(stripes)
+
+	if err := w.wal.error(); err != nil {
+		return false, 0, err
+	}
+
+	if !apply() {
+		return false, 0, nil
+	}
+
+	lsn, err := w.wal.add(op, sn, expiry, bs)
+	return true, lsn, err
+}
+
+// walKeyHash returns the hash which maps the equal keys to the same key lock
+// The items are hashed as a whole unless a custom key comparator is used. In
+// that case, the hash function of the hash index is used if it is set.
+// Otherwise, all the mutations share a lock.
+func (m *Nitro) walKeyHash() nodetable.HashFn {
+	if m.hashFn != nil {
+		return m.hashFn
+	} else if !m.customKeyCmp {
+		return crc32.ChecksumIEEE
+	}
+
+	return nil
+}
+
+// syncMutation waits until the logged mutation has been made durable
+func (w *Writer) syncMutation(lsn uint64, err error) error {
+	if w.wal == nil || err != nil || lsn == 0 {
+		return err
+	}
+
+	return w.wal.waitSync(lsn)
+}
+
+// encodeWALBatch encodes the mutations of a write batch as the data of a
+// batch record
+func encodeWALBatch(ops []batchOp) []byte {
+	sz := 0
+	for _, op := range ops {
+		sz += 5 + len(op.bs)
+	}
+
+	buf := make([]byte, 0, sz)
+	var hdr [5]byte
+	for _, op := range ops {
+		hdr[0] = walOpPut
+		if op.op == batchOpDelete {
+			hdr[0] = walOpDelete
+		}
+		binary.BigEndian.PutUint32(hdr[1:5], uint32(len(op.bs)))
+		buf = append(buf, hdr[:]...)
+		buf = append(buf, op.bs...)
+	}
+
+	return buf
+}
+
+// decodeWALBatch calls the function for every mutation of a batch record
+func decodeWALBatch(data []byte, fn func(op byte, bs []byte)) error {
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return ErrCorruptWAL
+		}
+
+		l := int(binary.BigEndian.Uint32(data[1:5]))
+		if len(data)-5 < l {
+			return ErrCorruptWAL
+		}
+
+		fn(data[0], data[5:5+l])
+		data = data[5+l:]
+	}
+
+	return nil
+}
+
+// replayWAL applies the mutations recorded in the log segments of the
+// previous instances. A partial record at the end of the last segment is
+// ignored as it belongs to a mutation which had not returned.
+// The mutations are applied using the snapshot number sn of the first
+// snapshot of the restored instance. No snapshot has been created yet.
+// Hence, the restored items deleted by the replay are not visible to any
+// snapshot and they are removed once the replay completes.
+func (m *Nitro) replayWAL(ctx context.Context, sn uint32) error {
+	w := m.newWriter()
+	defer m.store.Stats.Merge(&w.slSts1)
+
+	// The removed nodes are handed over to the free workers by the access
+	// barrier. The writers and their free workers may not have been created
+	// yet. Hence, a free worker is run until the replay completes.
+	if m.useMemoryMgmt {
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go m.replayFreeWorker(w, stop, done)
+		defer func() {
+			close(stop)
+			<-done
+		}()
+	}
+	defer w.removeReplayed()
+
+	apply := func(op byte, expiry uint32, bs []byte) {
+		switch op {
+		case walOpPut:
+			if w.put(bs, sn, expiry) != nil && expiry != 0 {
+				m.ttlItems++
+			}
+		case walOpDelete:
+			w.delete(bs, sn)
+		case walOpReplace:
+			w.delete(bs, sn)
+			w.put(bs, sn, expiry)
+		}
+	}
+
+	for i, path := range m.wal.replay {
+		if isCancelled(ctx) {
+			return ctx.Err()
+		}
+
+		var batchErr error
+		err := readWALSegment(path, func(op byte, expiry uint32, bs []byte) {
+			if op != walOpBatch {
+				apply(op, expiry, bs)
+			} else if batchErr == nil {
+				batchErr = decodeWALBatch(bs, func(op byte, bs []byte) {
+					apply(op, 0, bs)
+				})
+			}
+		})
+
+		if batchErr != nil {
+			return batchErr
+		} else if err == io.ErrUnexpectedEOF && i < len(m.wal.replay)-1 {
+			return ErrCorruptWAL
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+	}
+
+	m.wal.replayed()
+	return nil
+}
+
+// removeReplayed removes the nodes of the items deleted by the replay
+func (w *Writer) removeReplayed() {
+	if w.gchead == nil {
+		return
+	}
+
+	for n := w.gchead; n != nil; n = n.GetLink() {
+		w.store.DeleteNode(n, w.insCmp, w.buf, &w.slSts1)
+		w.deleteIndexes(n, w.buf)
+	}
+
+	barrier := w.store.GetAccesBarrier()
+	barrier.FlushSession(unsafe.Pointer(w.gchead))
+	w.gchead = nil
+	w.gctail = nil
+}
+
+// replayFreeWorker frees the removed nodes until it is stopped
+func (m *Nitro) replayFreeWorker(w *Writer, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case freelist := <-m.freechan:
+			m.freeNodes(freelist, &w.slSts3)
+		case <-stop:
+			m.store.Stats.Merge(&w.slSts3)
+			return
+		}
+	}
+}
+
+func (m *Nitro) truncateWAL(sn uint32) error {
+	if m.wal == nil {
+		return nil
+	}
+
+	return m.wal.truncate(sn)
+}